@@ -3,12 +3,14 @@ package main
 import (
 	"bufio"
     "fmt"
+	"io"
 	"github.com/octokit/go-octokit/octokit"
 	"github.com/jlaffaye/ftp"
 	"github.com/PuerkitoBio/goquery"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -20,13 +22,16 @@ import (
 )
 
 // 1/2/2006 3:4:5 PM
+// Dates on comments are printed differently, and are parsed by parsePostHeader.
 const dateFormat = "1/2/2006 3:4:5 PM"
-// Dates on comments are printed differently to dates on bugs.
-const commentDateFormat =  "2006-1-2 3:4 PM"
-// There is one comment which is a special snowflake.
-const shortCommentDateFormat = "2006-1-2"
 
-var blacklistedComments = []int64{ 686, 688, 32121, 32124, 32125, 32284, 32287, 32295, 32311, 32331, 32355, 32380, 32394, 32396, 32397, 32420, 32479, 32544, 32605, 32683, 32717, 32774, 32775, 32848, 32767, 32938, 32939, 32984, 33012, 33438, 33552, 33888, 33926, 33950, 33951, 34103, 34108, 34109, 34113, 34116, 34128, 34131, 34132, 33525, 33542, 33666, 33945, 33955, 34122, 34134 }
+// Time zone in which the bug tracker displays dates. The dates don't include
+// a UTC offset, so this must be supplied with --source-tz.
+var legacyLocation = time.UTC
+
+// True if --source-tz was given. Otherwise dates are assumed to be in UTC,
+// which is probably wrong.
+var legacyLocationGiven = false
 
 // Returns the smaller of two integers.
 // x: The first integer.
@@ -38,6 +43,16 @@ func min(x, y int) int {
 	return y
 }
 
+// Returns the larger of two integers.
+// x: The first integer.
+// y: The second integer.
+func maxInt(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
 // Creates a directory if it doesn't exist.
 func CreateDirIfNotExist(dir string) {
       if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -123,17 +138,6 @@ func loadBugList(rootUrl string) *goquery.Document {
 	return doc
 }
 
-// Checks if a comment is blacklisted.
-// id: ID of the comment.
-func isBlackListed(id int64) bool {
-	for _, b := range blacklistedComments {
-		if id == b {
-			return true
-		}
-	}
-	return false
-}
-
 // Reads a secret from a file on disk.
 // file: Path to the file on disk.
 func getSecret(file string) string {
@@ -145,75 +149,76 @@ func getSecret(file string) string {
 	return strings.TrimSpace(string(secret))
 }
 
-// Gets the comments for a particular bug ID.cls
-// Returns a slice of comments.
+// Fetches the page for a particular bug ID, which contains its comments and history.
 // rootUrl: Root URL of the bug tracker website.
 // Must contain trailing forward slash.
 // e.g. https://www.apsim.info/BugTracker/
-func getComments(rootUrl string, bugId int) (comments []Comment) {
+// bugId: ID of the bug.
+func loadBugPage(rootUrl string, bugId int) *goquery.Document {
 	threadDoc, err := goquery.NewDocument(rootUrl + "edit_bug.aspx?id=" + strconv.Itoa(bugId))
 	if err != nil {
 		log.Fatal(err)
 	}
+	return threadDoc
+}
+
+// Gets the comments for a particular bug ID.cls
+// Returns a slice of comments.
+// rootUrl: Root URL of the bug tracker website.
+// Must contain trailing forward slash.
+// e.g. https://www.apsim.info/BugTracker/
+// threadDoc: The bug's page.
+// bugId: ID of the bug.
+func getComments(rootUrl string, threadDoc *goquery.Document, bugId int) (comments []Comment) {
 	threadDoc.Find(".cmt").Each(func(i int, commentData *goquery.Selection) {
 		commentText := strings.TrimSpace(commentData.Find("table:nth-child(2)").Text())
 		
 		// Comment metadata is the sentence at the top of the comment which gives the
 		// Comment ID, author, and date.
-		commentMetadata := strings.TrimSpace(commentData.Find("span.pst").First().Text())
-		
-		// Replace any pesky non-breaking spaces with normal spaces, so we can
-		// split the string on the space character.
-		commentMetadata = stripNonBreakingSpaces(commentMetadata)
-		splitMetadata := strings.Split(commentMetadata, " ")
+		header, err := parsePostHeader(commentData.Find("span.pst").First().Text(), legacyLocation)
+		if err != nil {
+			fmt.Printf("Error parsing comment on Bug #%d\n", bugId)
+			log.Fatal(err)
+		}
 		
 		// Check if the post contains any attachments.
-		var attachment Attachment
-		if splitMetadata[0] == "file" {
+		var attachments []Attachment
+		if header.kind == "file" {
+			// Each file is a post of its own, with a single attachment.
 			attachmentInfo := commentData.Find(".pst")
-			attachmentNameNode := commentData.Find("img").Parent().Next()
-			// For now, ignore whether the href exists or not.
-			attachmentUrl, _ := attachmentNameNode.Next().Attr("href")
-			attachment = Attachment {
-				name : attachmentNameNode.Text(),
-				size : parseInt(strings.Split(stripNonBreakingSpaces(attachmentInfo.Last().Text()), " ")[1]),
-				url: rootUrl + attachmentUrl,
+			attachmentNameNode := commentData.Find("img").First().Parent().Next()
+			attachmentName := attachmentNameNode.Text()
+			// Files which are missing from the bug tracker have no link, so
+			// there's nothing to migrate.
+			if attachmentUrl, ok := attachmentNameNode.Next().Attr("href"); ok {
+				size, err := parseAttachmentSize(attachmentInfo.Last().Text())
+				if err != nil {
+					fmt.Printf("Error parsing size of %s on Bug #%d\n", attachmentName, bugId)
+					log.Fatal(err)
+				}
+				attachments = append(attachments, Attachment {
+					name : attachmentName,
+					size: size,
+					url: rootUrl + attachmentUrl,
+				})
+			} else {
+				summaryReport.Warn(logContext { bug: int64(bugId), comment: header.id }, "File %s has no link on the bug tracker, so it can't be migrated", attachmentName)
 			}
 		}
 		
-		// There is one comment(!) on one bug which is different to all other
-		// comments on all other bugs. The date reported for this comment
-		// is just yyyy-m-d (e.g. no time component). To work around this,
-		// check if the word which would normally hold the date actually
-		// contains a colon ":". If it doesn't contain a colon, this must be
-		// the special comment. 😡
-		n := len(splitMetadata) - 1
-		var commentDate time.Time
-		if strings.Contains(splitMetadata[n - 4], ":") {
-			commentDate, err = time.Parse(commentDateFormat , splitMetadata[n - 5] + " " + splitMetadata[n - 4] + " " + strings.Trim(splitMetadata[n - 3], ","))
-		} else {
-			commentDate, err = time.Parse(shortCommentDateFormat, strings.Trim(splitMetadata[n - 3], ","))
-		}
-		if err != nil {
-			fmt.Printf("Error parsing date for Bug #%d\n", bugId)
-			fmt.Printf("commentMetadata: %v\n", commentMetadata)
-			fmt.Printf("n: %d; date: %v\n", n, splitMetadata[n - 5])
-			log.Fatal(err)
-		}
-		
 		comment := Comment {
-			id: parseInt(splitMetadata[1]),
-			author: splitMetadata[4],
-			date: commentDate,
+			id: header.id,
+			author: header.author,
+			date: header.date,
+			dateText: header.dateText,
 			text: commentText,
-			attachment: attachment,
+			attachments: attachments,
 		}
+		comment.assignFileNames()
 		
-		// Skip this particular comment...
-		if !isBlackListed(comment.id) {
-			// Prepend the comment to the list of comments.
-			comments = append([]Comment { comment }, comments...)
-		}
+		// Prepend the comment to the list of comments. Spam etc. is removed
+		// later by the content filter.
+		comments = append([]Comment { comment }, comments...)
 	})
 	return
 }
@@ -225,6 +230,9 @@ func getComments(rootUrl string, bugId int) (comments []Comment) {
 // Must contain trailing forward slash.
 // e.g. https://www.apsim.info/BugTracker/
 func getBugs(verbosity, n int, url string) (bugs []Bug) {
+	if !legacyLocationGiven {
+		fmt.Println("Warning: --source-tz not provided, so dates on the bug tracker are assumed to be in UTC")
+	}
 	if verbosity > 0 {
 		fmt.Print("Downloading data...")
 	}
@@ -233,29 +241,31 @@ func getBugs(verbosity, n int, url string) (bugs []Bug) {
 		fmt.Println("Finished!")
 	}
 	
+	// The first row of the table is a header, and the last row is a footer.
 	bugRows := doc.Find("table.bugt tr")
-	numBugs := bugRows.IndexOfSelection(bugRows.Last())
+	numBugs := bugRows.Length() - 1
 	if n > 0 && n < numBugs {
 		numBugs = n
 	}
+	scrape := newProgress("Processing bugs", numBugs - 1, verbosity)
 	
 	bugRows.Each(func(index int, row *goquery.Selection) {
-		if verbosity > 0 {
-			fmt.Printf("Processing bugs...%.2f%%\r", float64(index) / float64(numBugs) * 100.0)
-		}
 		// Skip the first row of the table, as it doesn't contain bugs.
 		if index > 0 && index < numBugs {
+			defer scrape.Add(1)
 			bugId := parseInt(row.Find("td:nth-child(1)").Text())
 			if bugId > 2000 {
 				return
 			}
-			bugDate, err := time.Parse(dateFormat , row.Find("td:nth-child(8)").Text())
+			bugDateText := strings.TrimSpace(row.Find("td:nth-child(8)").Text())
+			bugDate, err := time.ParseInLocation(dateFormat, bugDateText, legacyLocation)
 			if err != nil {
 				fmt.Printf("Error parsing date in bug #%d\n", bugId)
 				// Bail immediately if we fail to parse a date.
 				log.Fatal(err)
 			}
 			
+			threadDoc := loadBugPage(url, int(bugId))
 			bug := Bug {
 				id: bugId,
 				description: row.Find("td:nth-child(4)").Text(),
@@ -265,14 +275,20 @@ func getBugs(verbosity, n int, url string) (bugs []Bug) {
 				category: row.Find("td:nth-child(6)").Text(),
 				author: strings.Replace(row.Find("td:nth-child(7)").Text(), ":", "", -1),
 				date: bugDate,
+				dateText: bugDateText,
 				assignee: row.Find("td:nth-child(9)").Text(),
-				comments : getComments(url, int(bugId)),
+				comments : getComments(url, threadDoc, int(bugId)),
+				history: getHistory(threadDoc, int(bugId)),
+				url: url + "edit_bug.aspx?id=" + strconv.Itoa(int(bugId)),
 			}
+			getRelations(url, &bug)
+			runLog.Debug(logContext { bug: bugId }, "Scraped bug with %d comments", len(bug.comments))
 			bugs = append([]Bug { bug }, bugs...)
 		}
 	})
+	summary := scrape.Finish()
 	if verbosity > 0 {
-		fmt.Printf("Processing bugs...Finished!\n")
+		fmt.Println(summary)
 	}
 	return
 }
@@ -320,11 +336,28 @@ func uploadFileFtp(remote, port, webRoot, remoteDir, localFile, user, pass strin
 	
 	err = conn.ChangeDir(webRoot)
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("Unable to change to web root %s: %v", webRoot, err)
+	}
+	root, err := conn.CurrentDir()
+	if err != nil {
+		return "", err
 	}
 	
-	// This will return an error if the directory already exists.
-	_ = conn.MakeDir(remoteDir)
+	// Create each level of the directory in turn. This will return an error
+	// if the directory already exists, so only give up if we can't change
+	// into it either.
+	dir := ""
+	for _, part := range strings.Split(remoteDir, "/") {
+		dir = path.Join(dir, part)
+		if err = conn.MakeDir(dir); err != nil {
+			if cdErr := conn.ChangeDir(dir); cdErr != nil {
+				return "", fmt.Errorf("Unable to create directory %s: %v", dir, err)
+			}
+			if err = conn.ChangeDir(root); err != nil {
+				return "", err
+			}
+		}
+	}
 	
 	file, err := os.Open(localFile)
 	if err != nil {
@@ -335,18 +368,173 @@ func uploadFileFtp(remote, port, webRoot, remoteDir, localFile, user, pass strin
 	remotePath := path.Join(remoteDir, filepath.Base(localFile))
 	err = conn.Stor(remotePath, file)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("Unable to upload %s: %v", remotePath, err)
 	}
 	
 	return strings.Trim(remote, "/") + "/" + remotePath, nil
 }
 
-// Pauses execution for a random duration.
-// min - minimum duration (in seconds).
-// max - maximum duration (in seconds).
-func randomSleep(min, max int) {
-	ms := min * 1000 + rand.Intn((max - min) * 1000)
-	time.Sleep(time.Duration(ms * int(time.Millisecond)))
+// Somewhere that attachments can be uploaded to, so that the migrated
+// comments can link to them.
+type attachmentStore interface {
+	// Uploads a local file into remoteDir and returns the file's public URL.
+	Upload(remoteDir, localFile string) (string, error)
+	// Gets the public URL of a file which has already been uploaded.
+	Url(remotePath string) string
+	// Finishes any uploads which are still pending.
+	Flush() error
+}
+
+// Stores attachments on a web server via FTP.
+type ftpStore struct {
+	host		string
+	port		string
+	webRoot		string
+	user		string
+	pass		string
+}
+
+// Creates an FTP attachment store. Credentials are read from credentials.txt.
+func newFtpStore(host, port, webRoot string) *ftpStore {
+	user, pass := getCredentials()
+	return &ftpStore { host: host, port: port, webRoot: webRoot, user: user, pass: pass }
+}
+
+func (f *ftpStore) Upload(remoteDir, localFile string) (string, error) {
+	url, err := uploadFileFtp(f.host, f.port, f.webRoot, remoteDir, localFile, f.user, f.pass)
+	if err != nil {
+		return "", err
+	}
+	// Links (and particularly images) need a scheme, otherwise GitHub treats
+	// them as relative URLs.
+	return "https://" + url, nil
+}
+
+func (f *ftpStore) Url(remotePath string) string {
+	return "https://" + strings.Trim(f.host, "/") + "/" + remotePath
+}
+
+// Files are uploaded immediately, so there is never anything to flush.
+func (f *ftpStore) Flush() error {
+	return nil
+}
+
+// Stores attachments by their content, so that identical files attached to
+// several comments are only uploaded once.
+type contentAddressedStore struct {
+	store		attachmentStore
+	// Maps SHA-256 hashes to the URLs of files which have already been uploaded.
+	urls		map[string]string
+	// Path to a manifest (in sha256sum format) of all uploaded files.
+	manifest	string
+	// Manifest lines for files which haven't been flushed yet.
+	pending		[]string
+	// Maximum width/height of image thumbnails. 0 to disable thumbnails.
+	thumbnailSize	int
+}
+
+// Name of the manifest of uploaded files, in the attachment cache.
+const manifestName = "attachments.sha256"
+
+// Reads the manifest of the files which were uploaded by content. If the
+// manifest doesn't exist, nothing has been uploaded.
+// Returns the path of each file, relative to the web root, by hash.
+// file: Path of the manifest.
+func loadManifest(file string) (map[string]string, error) {
+	paths := make(map[string]string)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return paths, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) == 2 {
+			paths[fields[0]] = fields[1]
+		}
+	}
+	return paths, nil
+}
+
+// Creates a content-addressed store on top of another attachment store.
+// Files recorded in the manifest by earlier runs aren't uploaded again.
+// store: The store to which files will be uploaded.
+// manifest: Path to a file in which the hash of each uploaded file is recorded.
+func newContentAddressedStore(store attachmentStore, manifest string) (*contentAddressedStore, error) {
+	paths, err := loadManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[string]string)
+	for hash, remotePath := range paths {
+		urls[hash] = store.Url(remotePath)
+	}
+	return &contentAddressedStore { store: store, urls: urls, manifest: manifest }, nil
+}
+
+// Uploads a downloaded attachment, unless a file with identical contents
+// has already been uploaded. Returns the URL of the stored file.
+// a: The attachment. Must have already been downloaded.
+// localFile: Path to the downloaded attachment.
+func (c *contentAddressedStore) Upload(a Attachment, localFile string) (string, error) {
+	if a.hash == "" {
+		return "", fmt.Errorf("Attachment %s has not been downloaded", a.name)
+	}
+	if url, ok := c.urls[a.hash]; ok {
+		return url, nil
+	}
+	remoteDir := "BugAttachments/sha256/" + a.hash
+	url, err := c.store.Upload(remoteDir, localFile)
+	if err != nil {
+		return "", err
+	}
+	c.urls[a.hash] = url
+	// The file isn't recorded in the manifest until it has been flushed, in
+	// case the run is interrupted before then.
+	c.pending = append(c.pending, fmt.Sprintf("%s  %s\n", a.hash, path.Join(remoteDir, filepath.Base(localFile))))
+	return url, nil
+}
+
+// Creates and uploads a thumbnail of a downloaded image. Returns the URL of
+// the thumbnail, or an empty string if thumbnails are disabled or the image
+// is small enough not to need one.
+// localFile: Path to the downloaded image.
+func (c *contentAddressedStore) UploadThumbnail(localFile string) (string, error) {
+	if c.thumbnailSize <= 0 {
+		return "", nil
+	}
+	thumbFile, err := createThumbnail(localFile, c.thumbnailSize)
+	if err != nil || thumbFile == "" {
+		return "", err
+	}
+	thumb := Attachment { name: filepath.Base(thumbFile) }
+	if thumb.hash, err = hashFile(thumbFile); err != nil {
+		return "", err
+	}
+	return c.Upload(thumb, thumbFile)
+}
+
+// Finishes any uploads which are still pending, and records them in the
+// manifest.
+func (c *contentAddressedStore) Flush() error {
+	if err := c.store.Flush(); err != nil {
+		return err
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	manifest, err := os.OpenFile(c.manifest, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = manifest.WriteString(strings.Join(c.pending, "")); err != nil {
+		manifest.Close()
+		return err
+	}
+	c.pending = nil
+	return manifest.Close()
 }
 
 // Posts a bug on GitHub
@@ -354,258 +542,230 @@ func randomSleep(min, max int) {
 // org: Name of the organisation/owner of the repo.
 // repo: Name of the GitHub repo to which the bug will be posted.
 // credFile: Path to file on disk containing an access token for a GitHub account.
-// reupload: If true, attachments will be downloaded from BugTracker, and uploaded to another site.
-func postBug(bug Bug, org, repo, credFile string, reupload bool) {
-	auth := octokit.TokenAuth{AccessToken: getSecret(credFile)}
-	client := octokit.NewClient(auth)
+// cacheDir: Directory in which downloaded attachments are cached.
+// store: If not nil, attachments will be downloaded from BugTracker, and uploaded to this store.
+// state: If not nil, the issue and its comments are recorded in the migration state.
+// history: How the bug's history is migrated (historyNone, historyTimeline or historyLabels).
+func postBug(bug Bug, org, repo, credFile, cacheDir string, store *contentAddressedStore, state *migrationState, history string) {
+	client := newGithubClient(credFile)
 	params := octokit.IssueParams {
 		Title: bug.description,
 		Body: bug.ToString(),
 	}
-	issue, result := client.Issues().Create(nil, octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic"}, params)
-	
-	for result.HasError() {
-		fmt.Printf("Encountered an error when attempting to post bug #%d\n", bug.id)
-		fmt.Printf("result.Error(): \"%v\"\n", result.Error())
-		if strings.Contains(result.Error(), "You have triggered an abuse detection mechanism and have been temporarily blocked from content creation.") {
-			fmt.Printf("Triggered abuse detection mechanism on bug ID %d\n", bug.id)
-			randomSleep(60, 120)
-			issue, result = client.Issues().Create(nil, octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic"}, params)
-		} else {
-			log.Fatal(result)
+	if history == historyLabels {
+		params.Labels = bug.HistoryLabels()
+	}
+	// Publish the bug's attachments before posting anything which links to them.
+	var comments []*Comment
+	for i := range bug.comments {
+		if i > 0 {
+			comments = append(comments, &bug.comments[i])
 		}
 	}
-	if result.RateLimitRemaining() < 10 {
-		time.Sleep(time.Hour)
+	publishAttachments(comments, bug.id, cacheDir, store)
+	issue, result := client.Issues().Create(nil, octokit.M{"owner": org, "repo": repo}, params)
+	if result.HasError() {
+		fmt.Printf("Encountered an error when attempting to post bug #%d\n", bug.id)
+		runLog.Error(logContext { bug: bug.id }, "Unable to post bug: %v", result)
+		log.Fatal(result)
 	}
-	tempDir := path.Join(os.TempDir(), "TransferIssues")
-	CreateDirIfNotExist(tempDir)
-	host := "www.apsim.info"
-	port := "21"
-	webRoot := "APSIM"
-	for i, comment := range bug.comments {
+	runLog.Info(logContext { bug: bug.id, issue: issue.Number }, "Posted issue")
+	postProgress.Add(1)
+	// Save the state after each step, so that an interrupted run doesn't
+	// post the bug or its comments again.
+	if state != nil {
+		state.RecordIssue(bug, issue.Number, "open")
+		saveState(state)
+	}
+	for i := range bug.comments {
 		if i > 0 { // temporary hack
-			// Deal with any attachments.
-			if comment.attachment != (Attachment{}) {
-				remoteDir := "BugAttachments/" + strconv.Itoa(int(comment.id))
-				bug.comments[i].attachment.url = strings.Trim(host, "/") + "/" + remoteDir + "/" + bug.comments[i].attachment.GetCleanFileName()
-				if reupload {
-					localFile, err := comment.attachment.Download(tempDir)
-					if err != nil {
-						fmt.Printf("Error downloading file %v for bug #%d!\n", comment.attachment.name, bug.id)
-						log.Fatal(err)
-					}
-					user, pass := getCredentials()
-					
-					bug.comments[i].attachment.url, err = uploadFileFtp(host, port, webRoot, remoteDir, localFile, user, pass)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-			}
-			input := octokit.M{"body": bug.comments[i].ToString()}
-			_, result := client.IssueComments().Create(nil, octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic", "number": issue.Number}, input)
-			for result.HasError() {
-				fmt.Printf("Encountered an error when attempting to post comment #%d\n", comment.id)
-				fmt.Printf("result.Error(): \"%v\"\n", result.Error())
-				if strings.Contains(result.Error(), "You have triggered an abuse detection mechanism and have been temporarily blocked from content creation.") {
-					randomSleep(60, 120)
-					_, result = client.IssueComments().Create(nil, octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic", "number": issue.Number}, input)
-				} else {
-					log.Fatal(result)
-				}
-			}
-			if result.RateLimitRemaining() < 10 {
-				time.Sleep(time.Hour)
-			} else {
-				randomSleep(5, 10)
+			githubComment := postComment(client, org, repo, bug.id, &bug.comments[i], issue.Number)
+			if state != nil {
+				state.RecordComment(bug.id, bug.comments[i], githubComment.ID)
+				saveState(state)
 			}
 		}
 	}
+	if timeline := bug.HistoryString(); history == historyTimeline && timeline != "" {
+		postIssueComment(client, org, repo, issue.Number, timeline)
+		postProgress.Add(1)
+	}
 	if bug.IsClosed() {
 		closeIssue(org, repo, credFile, issue.Number)
+		postProgress.Add(1)
+		runLog.Info(logContext { bug: bug.id, issue: issue.Number }, "Closed issue (legacy status %s)", bug.status)
+		if state != nil {
+			state.Bugs[bug.id].IssueState = "closed"
+			saveState(state)
+		}
 	}
 }
 
-func getGithubIssues(owner, repo, credFile string, max int) (issues []octokit.Issue) {
-	// Initialise github client
-	auth := octokit.TokenAuth{AccessToken: getSecret(credFile)}
-	client := octokit.NewClient(auth)
-	url := octokit.Hyperlink(fmt.Sprintf("repos/%s/%s/issues", owner, repo))
-	
-	// A few state variables
-	first := true
-	numIssues := 0
-	var progress float64
-	for {
-		bugs, result := client.Issues().All(&url, nil)
-		if result.HasError() {
-			log.Fatal(result)
-		}
-		
-		if first {
-			// First time through we record the issue number.
-			// This is used to calculate progress each iteration.
-			first = false
-			if len(bugs) > 0 {
-				numIssues = bugs[0].Number
-				if max < 0 {
-					max = numIssues
+// Posts a legacy comment on an issue. Its attachments must already have been
+// published with publishAttachments.
+// client: GitHub API client.
+// org: Name of the organisation/owner of the repo.
+// repo: Name of the repo.
+// bugId: ID of the legacy bug.
+// comment: The comment.
+// number: Number of the issue.
+func postComment(client *octokit.Client, org, repo string, bugId int64, comment *Comment, number int) *octokit.IssueComment {
+	posted := postIssueComment(client, org, repo, number, comment.ToString())
+	runLog.Info(logContext { bug: bugId, comment: comment.id, issue: number }, "Posted comment")
+	postProgress.Add(1)
+	return posted
+}
+
+// Points a comment's attachments at their new home. If a store is given,
+// the attachments are downloaded and uploaded to the store. Otherwise they
+// are assumed to have already been uploaded to www.apsim.info/BugAttachments.
+// comment: The comment. Its attachment URLs are updated.
+// bugId: ID of the legacy bug.
+// cacheDir: Directory in which downloaded attachments are cached.
+// store: If not nil, attachments will be downloaded from BugTracker, and uploaded to this store.
+func uploadAttachments(comment *Comment, bugId int64, cacheDir string, store *contentAddressedStore) {
+	host := "https://www.apsim.info"
+	for j := range comment.attachments {
+		attachment := &comment.attachments[j]
+		remoteDir := "BugAttachments/" + strconv.Itoa(int(comment.id))
+		attachment.url = strings.Trim(host, "/") + "/" + remoteDir + "/" + url.PathEscape(attachment.GetCleanFileName())
+		if store != nil {
+			context := logContext { bug: bugId, comment: comment.id }
+			localFile, err := attachment.Download(path.Join(cacheDir, strconv.Itoa(int(comment.id))), context)
+			if err != nil {
+				fmt.Printf("Error downloading file %v for bug #%d!\n", attachment.name, bugId)
+				runLog.Error(context, "Unable to download %s: %v", attachment.name, err)
+				log.Fatal(err)
+			}
+			downloadProgress.Add(1)
+			
+			if err = attachment.detectMimeType(localFile); err != nil {
+				log.Fatal(err)
+			}
+			attachment.url, err = store.Upload(*attachment, localFile)
+			if err != nil {
+				runLog.Error(context, "Unable to upload %s: %v", attachment.name, err)
+				log.Fatal(err)
+			}
+			runLog.Info(context, "Uploaded %s to %s", attachment.name, attachment.url)
+			uploadProgress.Add(1)
+			if attachment.IsImage() {
+				attachment.thumbnailUrl, err = store.UploadThumbnail(localFile)
+				if err != nil {
+					// Not all images can be decoded (e.g. bmp), but they can still be embedded.
+					fmt.Printf("Unable to create thumbnail of %v for bug #%d: %v\n", attachment.name, bugId, err)
+					summaryReport.Warn(context, "Unable to create thumbnail of %s: %v", attachment.name, err)
 				}
 			}
 		}
-		if len(bugs) > 0 {
-			progress = 100.0 * float64(numIssues - bugs[0].Number) / float64(numIssues)
-		}
-		fmt.Printf("Fetching GitHub issues: %.2f%%\r", progress)
-		issues = append(issues, bugs...)
-		if result.NextPage == nil || len(issues) >= max{
-			break
-		}
-		url = *result.NextPage
-		if result.RateLimitRemaining() < 5 {
-			fmt.Println("Rate limit exceeded. Sleeping for one hour...")
-			time.Sleep(time.Hour)
-			fmt.Println("One hour has elapsed. Resuming execution...")
-		}
 	}
-	fmt.Printf("Fetching GitHub issues...Finished!\n")
-	return
 }
 
-// I forgot to put https:// in front of attachment links. This function goes
-// through all issues in the repository and fixes this mistake.
-func fixLinks(credFile string, verbosity int) {
-	re := regexp.MustCompile(`(\[[^\]]+\])\(www.apsim.info`)
-	replaceRegex := "$1(https://www.apsim.info"
-	auth := octokit.TokenAuth{AccessToken: getSecret(credFile)}
-	client := octokit.NewClient(auth)
-	apsimUrl := octokit.Hyperlink("repos/APSIMInitiative/APSIMClassic/issues")
-	first := true
-	numIssues := -1
-	var progress float64
-	for {
-		issues, result := client.Issues().All(&apsimUrl, nil)
-		if result.HasError() {
-			log.Fatal(result)
+// Uploads the attachments of some of a bug's comments, then flushes the
+// store. Some stores (e.g. git) don't publish files until they're flushed,
+// and comments mustn't link to files which don't exist yet. Flushing once
+// per bug lets the store batch the bug's files together.
+// comments: The comments. Their attachment URLs are updated.
+// bugId: ID of the legacy bug.
+// cacheDir: Directory in which downloaded attachments are cached.
+// store: If not nil, attachments will be downloaded from BugTracker, and uploaded to this store.
+func publishAttachments(comments []*Comment, bugId int64, cacheDir string, store *contentAddressedStore) {
+	numAttachments := 0
+	for _, comment := range comments {
+		uploadAttachments(comment, bugId, cacheDir, store)
+		numAttachments += len(comment.attachments)
+	}
+	if store != nil && numAttachments > 0 {
+		if err := store.Flush(); err != nil {
+			runLog.Error(logContext { bug: bugId }, "Unable to publish attachments: %v", err)
+			log.Fatal(err)
 		}
-		for _, issue := range issues {
-			if first {
-				first = false
-				numIssues = issue.Number
-			}
-			progress = 100.0 * float64(numIssues - issue.Number) / float64(numIssues)
-			fmt.Printf("Fixing links...%.2f%%\r", progress)
-			comments, result := client.IssueComments().All(&octokit.IssueCommentsURL, octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic", "number": issue.Number})
-			if result.HasError() {
-				log.Fatal(result)
-			}
-			for _, comment := range comments {
-				if re.MatchString(comment.Body) {
-					if verbosity > 1 {
-						fmt.Printf("Updating comment %d on bug %d\n", comment.ID, issue.Number)
-					}
-					comment.Body = re.ReplaceAllString(comment.Body, replaceRegex)
-					fmt.Printf("Replacing comment on bug %d with:\n%s\n", issue.Number, comment.Body)
-					input := octokit.M{"body": comment.Body}
-					m := octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic", "id": comment.ID}
-					_, result = client.IssueComments().Update(nil, m, input)
-					if result.HasError() {
-						log.Fatal(result)
-					} else if result.RateLimitRemaining() < 10 {
-						time.Sleep(time.Hour)
-					}
+	}
+}
+
+// Downloads all attachments into the attachment cache, so that they don't
+// need to be downloaded during the migration itself. Failed downloads are
+// reported at the end rather than aborting the prefetch.
+// bugs: Bugs whose attachments will be downloaded.
+// cacheDir: Directory in which downloaded attachments are cached.
+// verbosity: level of output detail.
+func prefetchAttachments(bugs []Bug, cacheDir string, verbosity int) {
+	var failures []string
+	download := newProgress("Downloading attachments", countAttachments(bugs), verbosity)
+	for _, bug := range bugs {
+		for _, comment := range bug.comments {
+			for _, attachment := range comment.attachments {
+				context := logContext { bug: bug.id, comment: comment.id }
+				_, err := attachment.Download(path.Join(cacheDir, strconv.Itoa(int(comment.id))), context)
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("Bug #%d, comment %d (%s): %v", bug.id, comment.id, attachment.name, err))
+					summaryReport.Error(context, "Unable to download %s: %v", attachment.name, err)
 				}
+				download.Add(1)
 			}
 		}
-		if result.NextPage == nil {
-			break
+	}
+	summary := download.Finish()
+	if verbosity > 0 {
+		fmt.Println(summary)
+	}
+	if len(failures) > 0 {
+		fmt.Printf("Unable to download %d attachments:\n", len(failures))
+		for _, failure := range failures {
+			fmt.Println(failure)
 		}
-		apsimUrl = *result.NextPage
 	}
-	fmt.Printf("Fixing links...Finished!")
 }
 
-func fixLinksv2(credFile, rootUrl string, verbosity, n int) {
-	bugs := getBugs(verbosity, n, rootUrl)
-	re := regexp.MustCompile(`\[([^\]]+)\]\(https://www.apsim.info/BugTracker[^\)]+\)`)
+// Fetches issues from a GitHub repo, newest first.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// state: Only fetch issues in this state (open, closed, or all).
+// max: Max number of issues to fetch. Negative for unlimited.
+// verbosity: level of output detail.
+func getGithubIssues(owner, repo, credFile, state string, max int, verbosity int) (issues []octokit.Issue) {
+	// Initialise github client
+	client := newGithubClient(credFile)
+	link := octokit.Hyperlink(fmt.Sprintf("repos/%s/%s/issues?state=%s", owner, repo, state))
 	
-	auth := octokit.TokenAuth{AccessToken: getSecret(credFile)}
-	client := octokit.NewClient(auth)
-	apsimUrl := octokit.Hyperlink("repos/APSIMInitiative/APSIMClassic/issues")
+	// Progress is measured in pages. The number of pages is given by the
+	// link to the last page, which is only on the first page.
+	fetch := newProgress("Fetching GitHub issues", 0, verbosity)
 	first := true
-	numIssues := -1
-	var progress float64
 	for {
-		issues, result := client.Issues().All(&apsimUrl, nil)
+		bugs, result := client.Issues().All(&link, nil)
 		if result.HasError() {
 			log.Fatal(result)
 		}
-		for _, issue := range issues {
-			if first {
-				first = false
-				numIssues = issue.Number
-			}
-			progress = 100.0 * float64(numIssues - issue.Number) / float64(numIssues)
-			fmt.Printf("Fixing links...%.2f%%\r", progress)
-			comments, result := client.IssueComments().All(&octokit.IssueCommentsURL, octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic", "number": issue.Number})
-			if result.HasError() {
-				log.Fatal(result)
-			}
-			for i, comment := range comments {
-				if re.MatchString(comment.Body) {
-					if verbosity > 1 {
-						fmt.Printf("Match found for comment %d on bug %d\n", i + 1, issue.Number)
-					}
-					matches := re.FindStringSubmatch(comment.Body)
-					if len(matches) >= 2 {
-						legacyId := getLegacyId(issue)
-						var bug Bug
-						if legacyId >= 0 {
-							bug = getBugFromId(bugs, legacyId)
-						} else {
-							bug = getBugFromTitle(bugs, issue.Title)
-						}
-						legacyComment := getCommentWithContent(bug.comments, matches[1])
-						
-						attachmentName := strings.Replace(matches[1], " ", "_", -1)
-						replaceRegex := fmt.Sprintf("[$1](https://www.apsim.info/BugAttachments/%d/%s)", legacyComment.id, attachmentName)
-						newBody := re.ReplaceAllString(comment.Body, replaceRegex)
-						
-						input := octokit.M{"body": newBody}
-						m := octokit.M{"owner": "APSIMInitiative", "repo": "APSIMClassic", "id": comment.ID}
-						_, result = client.IssueComments().Update(nil, m, input)
-						if result.HasError() {
-							log.Fatal(result)
-						} else if result.RateLimitRemaining() < 10 {
-							time.Sleep(time.Hour)
-						}
-					} else if verbosity > 1 {
-						fmt.Printf("Number of matches: %d\n", len(matches))
-					}
-				} else if verbosity > 1 {
-						fmt.Printf("No match found for comment %d on bug #%d\n", i + 1, issue.Number)
-				}
+		if first {
+			first = false
+			if result.LastPage != nil {
+				fetch.SetTotal(pageNumber(*result.LastPage))
 			}
 		}
-		if result.NextPage == nil {
+		fetch.Add(1)
+		issues = append(issues, bugs...)
+		if result.NextPage == nil || (max >= 0 && len(issues) >= max) {
 			break
 		}
-		apsimUrl = *result.NextPage
+		link = *result.NextPage
+	}
+	if verbosity > 0 {
+		fmt.Println(fetch.Finish())
 	}
-	fmt.Printf("Fixing links...Finished!")
+	return
 }
 
-func getCommentWithContent(comments []Comment, content string) Comment {
-	for _, comment := range comments {
-		if strings.Contains(comment.text, content) {
-			return comment
-		}
-	}
-	for _, comment := range comments {
-		fmt.Printf("Comment: %s\n", comment.text)
+// Gets the page number from a link to a page of results, or 0 if it has none.
+// link: The link.
+func pageNumber(link octokit.Hyperlink) int {
+	parsed, err := url.Parse(string(link))
+	if err != nil {
+		return 0
 	}
-	panic(fmt.Sprintf("Unable to get comment with a content %s.", content))
+	page, _ := strconv.Atoi(parsed.Query().Get("page"))
+	return page
 }
 
 func getLegacyId(issue octokit.Issue) int {
@@ -635,133 +795,55 @@ func getLegacyId(issue octokit.Issue) int {
 	return -1
 }
 
-// Finds the bug with the given ID.
+// Finds the legacy bug which was migrated to an issue. Returns false if
+// there is no such bug.
 // bugs: list of bugs.
-// id: ID of the bug.
-func getBugFromId(bugs []Bug, id int) Bug {
-	for _, issue := range bugs {
-		if issue.id == int64(id) {
-			return issue
-		}
+// issue: The issue.
+func findBugForIssue(bugs []Bug, issue octokit.Issue) (Bug, bool) {
+	if legacyId := getLegacyId(issue); legacyId >= 0 {
+		return findBugById(bugs, int64(legacyId))
+	}
+	bug, ok := findBugByTitle(bugs, issue.Title)
+	if ok {
+		summaryReport.Warn(logContext { bug: bug.id, issue: issue.Number }, "Issue has no legacy bug ID, so it was matched to the bug with the same title")
 	}
-	panic(fmt.Sprintf("Unable to find bug with ID %d\n", id))
+	return bug, ok
 }
 
-// Finds the bug with the given title.
+// Finds the bug with the given title. Returns false if there is no such bug.
 // bugs: list of bugs.
 // title: Title of the bug.
-func getBugFromTitle(bugs []Bug, title string) Bug {
+func findBugByTitle(bugs []Bug, title string) (Bug, bool) {
 	for _, bug := range bugs {
 		if bug.description == title {
-			return bug
+			return bug, true
 		}
 	}
-	panic(fmt.Sprintf("Unable to find bug with title %s\n", title))
+	return Bug{}, false
 }
+
 // Closes a GitHub issue
 // owner: Owner of the repo.
 // repo: Name of the repo.
 // credFile: path to a file on disk containing a github personal access token.
 // id: ID of the issue to close.
 func closeIssue(owner, repo, credFile string, id int) {
-	auth := octokit.TokenAuth{AccessToken: getSecret(credFile)}
-	client := octokit.NewClient(auth)
+	setIssueState(owner, repo, credFile, id, "closed")
+}
+
+// Opens or closes a GitHub issue
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// id: ID of the issue.
+// state: The new state of the issue (open or closed).
+func setIssueState(owner, repo, credFile string, id int, state string) {
+	client := newGithubClient(credFile)
 	m := octokit.M{"owner": owner, "repo": repo, "number": id}
-	params := octokit.IssueParams{State: "closed"}
+	params := octokit.IssueParams{State: state}
 	_, result := client.Issues().Update(nil, m, params)
 	if result.HasError() {
 		log.Fatal(result)
-	} else if result.RateLimitRemaining() < 5 {
-		fmt.Println("GitHub API rate limit exceeded. Waiting for one hour...")
-		time.Sleep(time.Hour)
-		fmt.Println("One hour has elapsed. Resuming execution...")
-	}
-}
-
-// Fetches bugs from bug tracker site and for those which are closed,
-// closes their github counterpart.
-// credFile: credentials file containing a github personal access token.
-// verbosity: level of output detail
-func closeIssues(rootUrl, credFile string, verbosity, maxBugs int) {
-	owner := "APSIMInitiative"
-	repo := "APSIMClassic"
-	issues := getGithubIssues(owner, repo, credFile, maxBugs)
-	bugTrackerIssues := getBugs(verbosity, maxBugs, rootUrl)
-	for _, issue := range issues {
-		legacyId := getLegacyId(issue)
-		var legacyIssue Bug
-		if legacyId >= 0 {
-			legacyIssue = getBugFromId(bugTrackerIssues, legacyId)	
-		} else {
-			legacyIssue = getBugFromTitle(bugTrackerIssues, issue.Title)
-		}
-		if legacyIssue.IsClosed() && strings.ToLower(issue.State) != "closed" {
-			fmt.Printf("Closing issue %d (#%d - %s)\n", legacyId, issue.Number, issue.State)
-			closeIssue(owner, repo, credFile, issue.Number)
-		} else {
-			fmt.Printf("Skipping issue %d (#%d - %s)\n", legacyId, issue.Number, issue.State)
-		}
-	}
-}
-
-// Fixes formatting of bugs which incorrectly have tabs inserted in them.
-func fixFormatting(credFile string, verbosity, n int) {
-	auth := octokit.TokenAuth{AccessToken: getSecret(credFile)}
-	client := octokit.NewClient(auth)
-	var m octokit.M
-	owner := "APSIMInitiative"
-	repo := "APSIMClassic"
-	issues := getGithubIssues(owner, repo, credFile, n)
-	numIssues := len(issues)
-	var progress float64
-	for i, issue := range issues {
-		progress = 100.0 * float64(i) / float64(numIssues)
-		fmt.Printf("Fixing formatting: %.2f%%\r", progress)
-		if strings.Contains(issue.Body, "\t") {
-			newBody := strings.Replace(issue.Body, "\t", "", -1)
-			if verbosity > 1 {
-				fmt.Printf("Replacing tabs in Bug #%d\n", issue.Number)
-				if verbosity > 2 {
-					fmt.Printf("\"%s\"\n", issue.Body)
-					fmt.Printf("\"%s\"\n", newBody)
-					fmt.Println("------------------------------------------------")
-				}
-			}
-			m = octokit.M{"owner": owner, "repo": repo, "number": issue.Number}
-			params := octokit.IssueParams {Body: newBody}
-			_, result := client.Issues().Update(nil, m, params)
-			if result.HasError() {
-				log.Fatal(result)
-			} else if result.RateLimitRemaining() < 5 {
-				fmt.Println("GitHub API rate limit exceeded. Waiting for one hour...")
-				time.Sleep(time.Hour)
-				fmt.Println("One hour has elapsed. Resuming execution...")
-			}
-		}
-		
-		// Fix formatting for comments on this issue
-		comments, result := client.IssueComments().All(&octokit.IssueCommentsURL, octokit.M{"owner": owner, "repo": repo, "number": issue.Number})
-		if result.HasError() {
-			log.Fatal(result)
-		}
-		for commentNo, comment := range comments {
-			if strings.Contains(comment.Body, "\t") {
-				if verbosity > 1 {
-					fmt.Printf("Updating comment %d of issue #%d\n", commentNo + 1, issue.Number)
-				}
-				newCommentBody := strings.Replace(comment.Body, "\t", "", -1)
-				m = octokit.M{"owner": owner, "repo": repo, "id": comment.ID}
-				params := octokit.M{"body": newCommentBody}
-				_, result = client.IssueComments().Update(nil, m, params)
-				if result.HasError() {
-					log.Fatal(result)
-				} else if result.RateLimitRemaining() < 5 {
-					fmt.Println("GitHub API rate limit exceeded. Waiting for one hour...")
-					time.Sleep(time.Hour)
-					fmt.Println("One hour has elapsed. Resuming execution...")
-				}
-			}
-		}
 	}
 }
 
@@ -772,9 +854,50 @@ func main() {
 	maxBugs := -1
 	doupload := false
 	fixlinks := false
-	closeissues := false
+	reconcile := false
+	reopen := false
+	lockMode := lockNone
+	lockReason := "resolved"
+	historyMode := historyNone
+	linkRelated := false
+	mentionSubscribers := false
+	spamCheck := false
+	spamReport := "spam-report.json"
+	usersFile := ""
+	logDir := "logs"
+	reportFile := ""
+	logLevel := levelInfo
+	filtersFile := ""
+	filterReport := ""
+	keepExcluded := false
+	conflictPolicy := conflictPolicyGithub
+	stateReport := "state-report.json"
 	fixformatting := false
 	fixlinks2 := false
+	gitRemote := ""
+	gitBranch := "master"
+	gitRawUrl := ""
+	gitBatch := 50
+	cacheDir := "attachment-cache"
+	pace := 5
+	tokenEnv := ""
+	tokenCommand := ""
+	appId := ""
+	installationId := ""
+	appKey := ""
+	thumbnailSize := 0
+	prefetch := false
+	verify := false
+	dedupe := false
+	synchronise := false
+	stateFile := "migration-state.json"
+	rewrite := false
+	rulesFile := ""
+	issueRange := ""
+	dryRun := false
+	verifyAttachments := false
+	verifyReport := "verify-report.json"
+	archive := ""
 	// Process command line arguments.
 	for i := 0; i < len(os.Args); i++ {
 		arg := os.Args[i]
@@ -801,39 +924,451 @@ func main() {
 		} else if arg == "--fix-links" {
 			fixlinks = true
 		} else if arg == "--close-issues" {
-			closeissues = true
+			reconcile = true
+		} else if arg == "--history" {
+			if i + 1 < len(os.Args) {
+				i++
+				historyMode = os.Args[i]
+				if historyMode != historyNone && historyMode != historyTimeline && historyMode != historyLabels {
+					log.Fatal(fmt.Sprintf("Error: unknown history mode %s (expected %s, %s or %s)", historyMode, historyNone, historyTimeline, historyLabels))
+				}
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--source-tz" {
+			if i + 1 < len(os.Args) {
+				i++
+				location, err := time.LoadLocation(os.Args[i])
+				if err != nil {
+					log.Fatal(fmt.Sprintf("Error: unknown time zone %s: %v", os.Args[i], err))
+				}
+				legacyLocation = location
+				legacyLocationGiven = true
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--detect-spam" {
+			spamCheck = true
+		} else if arg == "--spam-report" {
+			if i + 1 < len(os.Args) {
+				i++
+				spamReport = os.Args[i]
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--link-related" {
+			linkRelated = true
+			scrapeRelations = true
+		} else if arg == "--mention-subscribers" {
+			mentionSubscribers = true
+		} else if arg == "--users" {
+			if i + 1 < len(os.Args) {
+				i++
+				usersFile = os.Args[i]
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--report" {
+			if i + 1 < len(os.Args) {
+				i++
+				reportFile = os.Args[i]
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--log-dir" || arg == "--log-level" {
+			if i + 1 < len(os.Args) {
+				i++
+				if arg == "--log-dir" {
+					logDir = os.Args[i]
+				} else {
+					logLevel = os.Args[i]
+				}
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--filters" || arg == "--filter-report" {
+			if i + 1 < len(os.Args) {
+				i++
+				if arg == "--filters" {
+					filtersFile = os.Args[i]
+				} else {
+					filterReport = os.Args[i]
+				}
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--keep-excluded" {
+			keepExcluded = true
+		} else if arg == "--lock-issues" {
+			if i + 1 < len(os.Args) {
+				i++
+				lockMode = os.Args[i]
+				if lockMode != lockClosed && lockMode != lockAll {
+					log.Fatal(fmt.Sprintf("Error: unknown lock mode %s (expected %s or %s)", lockMode, lockClosed, lockAll))
+				}
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--lock-reason" {
+			if i + 1 < len(os.Args) {
+				i++
+				lockReason = os.Args[i]
+				if !isLockReason(lockReason) {
+					log.Fatal(fmt.Sprintf("Error: unknown lock reason %s (expected one of: %s)", lockReason, strings.Join(lockReasons, ", ")))
+				}
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--reconcile-states" {
+			reconcile = true
+			reopen = true
+		} else if arg == "--conflict-policy" {
+			if i + 1 < len(os.Args) {
+				i++
+				conflictPolicy = os.Args[i]
+				if conflictPolicy != conflictPolicyLegacy && conflictPolicy != conflictPolicyGithub {
+					log.Fatal(fmt.Sprintf("Error: unknown conflict policy %s (expected %s or %s)", conflictPolicy, conflictPolicyLegacy, conflictPolicyGithub))
+				}
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--state-report" {
+			if i + 1 < len(os.Args) {
+				i++
+				stateReport = os.Args[i]
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
 		} else if arg == "--fix-formatting" {
 			fixformatting = true
 		} else if arg == "--fix-links2" {
 			fixlinks2 = true
+		} else if arg == "--rewrite" {
+			rewrite = true
+		} else if arg == "--rules" || arg == "--issues" {
+			if i + 1 >= len(os.Args) {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+			i++
+			if arg == "--rules" {
+				rulesFile = os.Args[i]
+			} else {
+				issueRange = os.Args[i]
+			}
+		} else if arg == "--sync" {
+			synchronise = true
+		} else if arg == "--state" {
+			if i + 1 < len(os.Args) {
+				i++
+				stateFile = os.Args[i]
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--dedupe" {
+			dedupe = true
+		} else if arg == "--dry-run" {
+			dryRun = true
+		} else if arg == "--verify" {
+			verify = true
+		} else if arg == "--verify-attachments" {
+			verifyAttachments = true
+		} else if arg == "--verify-report" || arg == "--archive" {
+			if i + 1 >= len(os.Args) {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+			i++
+			if arg == "--verify-report" {
+				verifyReport = os.Args[i]
+			} else {
+				archive = os.Args[i]
+			}
+		} else if arg == "--prefetch-attachments" {
+			prefetch = true
+		} else if arg == "--thumbnails" {
+			if i + 1 < len(os.Args) {
+				i++
+				thumbnailSize = int(parseInt(os.Args[i]))
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--token-env" || arg == "--token-command" || arg == "--app-id" || arg == "--installation-id" || arg == "--app-key" {
+			if i + 1 >= len(os.Args) {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+			i++
+			switch arg {
+			case "--token-env":
+				tokenEnv = os.Args[i]
+			case "--token-command":
+				tokenCommand = os.Args[i]
+			case "--app-id":
+				appId = os.Args[i]
+			case "--installation-id":
+				installationId = os.Args[i]
+			case "--app-key":
+				appKey = os.Args[i]
+			}
+		} else if arg == "--pace" {
+			if i + 1 < len(os.Args) {
+				i++
+				pace = int(parseInt(os.Args[i]))
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--cache-dir" {
+			if i + 1 < len(os.Args) {
+				i++
+				cacheDir = os.Args[i]
+			} else {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+		} else if arg == "--git-store" || arg == "--git-branch" || arg == "--git-raw-url" || arg == "--git-batch" {
+			if i + 1 >= len(os.Args) {
+				log.Fatal(fmt.Sprintf("Error: %v argument provided, but no value provided!", arg))
+			}
+			i++
+			switch arg {
+			case "--git-store":
+				gitRemote = os.Args[i]
+			case "--git-branch":
+				gitBranch = os.Args[i]
+			case "--git-raw-url":
+				gitRawUrl = os.Args[i]
+			case "--git-batch":
+				gitBatch = int(parseInt(os.Args[i]))
+			}
+		}
+	}
+	githubLimiter.creationInterval = time.Duration(pace) * time.Second
+
+	// Keep a log of runs which change anything. Fatal errors are logged too.
+	if !spamCheck && !verify && !dryRun {
+		logFile, err := runLog.Open(logDir, logLevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer runLog.Close()
+		if verbosity > 0 {
+			fmt.Printf("Logging to %s\n", logFile)
+		}
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, runLog, summaryReport))
+	// Other commands only write a report if asked to. Migrations always do.
+	summaryReport.file = reportFile
+	runLog.Info(logContext{}, "Started: %s", strings.Join(os.Args[1:], " "))
+	
+	// Configure GitHub authentication. If none of these are given, the token(s)
+	// in secret.txt are used.
+	var sources []tokenSource
+	if appId != "" || installationId != "" || appKey != "" {
+		if appId == "" || installationId == "" || appKey == "" {
+			log.Fatal("Error: --app-id, --installation-id and --app-key must all be provided to authenticate as a GitHub App")
+		}
+		app, err := newAppTokenSource(appId, installationId, appKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sources = append(sources, app)
+	}
+	if tokenEnv != "" {
+		tokens, err := getTokensFromEnv(tokenEnv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sources = append(sources, tokens...)
+	}
+	if tokenCommand != "" {
+		tokens, err := getTokensFromCommand(tokenCommand)
+		if err != nil {
+			log.Fatal(err)
 		}
+		sources = append(sources, tokens...)
+	}
+	if len(sources) > 0 {
+		githubLimiter.tokens = newTokenPool(sources...)
+	}
+
+	// Spam etc. is excluded by the filter rules: the rules from the rules file
+	// (if any), followed by the comments which have always been excluded.
+	// The file's rules come first so that their numbers in error messages
+	// match the file. This has to happen after --source-tz is parsed, since
+	// the rules' dates are in the bug tracker's time zone.
+	var filterRules []filterRule
+	var err error
+	if filtersFile != "" {
+		if filterRules, err = loadFilterRules(filtersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	filterRules = append(filterRules, defaultFilterRules...)
+	if contentFilter, err = newFilter(filterRules); err != nil {
+		log.Fatal(err)
 	}
-	if fixlinks {
-		fixLinks("secret.txt", verbosity)
-	} else if fixlinks2 {
-		fixLinksv2("secret.txt", rootUrl, verbosity, maxBugs)
-	} else if closeissues {
-		closeIssues(rootUrl, "secret.txt", verbosity, maxBugs)
-	} else if fixformatting {
-		fixFormatting("secret.txt", verbosity, maxBugs)
-	}else {
+	contentFilter.keepExcluded = keepExcluded
+	contentFilter.report = filterReport
+
+	if spamCheck {
+		candidates := detectSpam(loadBugs(archive, verbosity, maxBugs, rootUrl))
+		if err := writeSpamReport(spamReport, candidates); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Found %d comments which look like spam. Report written to %s\n", len(candidates), spamReport)
+		if len(candidates) > 0 {
+			fmt.Println("Review the report, then exclude the spam with a filter rules file (--filters).")
+		}
+	} else if rewrite || fixlinks || fixlinks2 || fixformatting {
+		// The old fix commands are now just sets of rewrite rules.
+		var rules []rewriteRule
+		if rulesFile != "" {
+			var err error
+			if rules, err = loadRewriteRules(rulesFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if fixlinks {
+			rules = append(rules, fixLinksRules...)
+		}
+		if fixlinks2 {
+			rules = append(rules, fixLinks2Rules...)
+		}
+		if fixformatting {
+			rules = append(rules, fixFormattingRules...)
+		}
+		if len(rules) == 0 {
+			log.Fatal("Error: no rewrite rules provided. Use --rules to specify a rules file.")
+		}
+		r, err := newRewriter(rules, func() []Bug { return loadBugs(archive, verbosity, maxBugs, rootUrl) })
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.cacheDir = cacheDir
+		if r.uploaded, err = loadManifest(path.Join(cacheDir, manifestName)); err != nil {
+			log.Fatal(err)
+		}
+		first, last := 0, 0
+		if issueRange != "" {
+			first, last = parseIssueRange(issueRange)
+		}
+		rewriteIssues(r, "APSIMInitiative", "APSIMClassic", "secret.txt", first, last, dryRun, verbosity)
+	} else if reconcile {
+		state, err := loadState(stateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Always scrape the bug tracker, since the point is to pick up status changes.
+		bugs := scrapeBugs("", verbosity, maxBugs, rootUrl)
+		report := reconcileStates(bugs, state, "APSIMInitiative", "APSIMClassic", "secret.txt", conflictPolicy, reopen, dryRun, verbosity)
+		if err := writeStateReport(stateReport, report); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Found %d issues whose state differs from their legacy bug. Report written to %s\n", len(report), stateReport)
+	} else if linkRelated {
+		// Mentions notify people, so they're only made when asked for.
+		var users map[string]string
+		if mentionSubscribers {
+			if usersFile == "" {
+				log.Fatal("Error: --mention-subscribers requires --users")
+			}
+			var err error
+			if users, err = loadUserMap(usersFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		bugs := loadBugs(archive, verbosity, maxBugs, rootUrl)
+		linkRelatedIssues(bugs, "APSIMInitiative", "APSIMClassic", "secret.txt", users, dryRun, verbosity)
+	} else if prefetch {
+		prefetchAttachments(loadBugs(archive, verbosity, maxBugs, rootUrl), cacheDir, verbosity)
+	} else if dedupe {
+		state, err := loadState(stateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dedupeIssues("APSIMInitiative", "APSIMClassic", "secret.txt", state, dryRun, verbosity)
+	} else if verify {
+		bugs := loadBugs(archive, verbosity, maxBugs, rootUrl)
+		// When only some bugs are checked, issues for the others aren't orphans.
+		report := verifyMigration(bugs, "APSIMInitiative", "APSIMClassic", "secret.txt", maxBugs < 0, verifyAttachments, verbosity)
+		if err := writeVerifyReport(verifyReport, report); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Found %d discrepancies. Report written to %s\n", len(report), verifyReport)
+	} else {
+		if summaryReport.file == "" {
+			summaryReport.file = "migration-report.md"
+		}
 		fmt.Printf("doupload=%v\n", doupload)
-		// Get list of bugs.
-		bugs := getBugs(verbosity, maxBugs, rootUrl)
-		for i, bug := range bugs {
-			if verbosity > 0 {
-				fmt.Printf("Posting bugs...%.2f%%\r", float64(i) / float64(len(bugs)) * 100.0)
-			}
-			// Force attachments to be redownloaded/uploaded by setting the final
-			// paramter to true.
-			if bug.id >= 0 { // Use this to resume from a failed/aborted execution.
-				postBug(bug, "APSIMInitiative", "APSIMClassic", "secret.txt", doupload)
-				// Wait 10 seconds between posting each bug to avoid triggering
-				// an API abuse error.
-				randomSleep(5, 10)
-			}
-		}
-		fmt.Println("Uploading attachments...Finished!")
+		var store *contentAddressedStore
+		CreateDirIfNotExist(cacheDir)
+		manifest := path.Join(cacheDir, manifestName)
+		if gitRemote != "" {
+			workDir := path.Join(os.TempDir(), "TransferIssues", "legacy-attachments")
+			gitStore, err := newGitStore(gitRemote, gitBranch, gitRawUrl, workDir, gitBatch)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if store, err = newContentAddressedStore(gitStore, manifest); err != nil {
+				log.Fatal(err)
+			}
+		} else if doupload {
+			var err error
+			if store, err = newContentAddressedStore(newFtpStore("www.apsim.info", "21", "APSIM"), manifest); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if store != nil {
+			store.thumbnailSize = thumbnailSize
+		}
+		state, err := loadState(stateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var bugs []Bug
+		if synchronise {
+			// Always scrape the bug tracker, since the point is to pick up changes.
+			bugs = scrapeBugs(archive, verbosity, maxBugs, rootUrl)
+			summaryReport.AddBugs(bugs, state, "APSIMInitiative", "APSIMClassic")
+			syncIssues(bugs, state, "APSIMInitiative", "APSIMClassic", "secret.txt", cacheDir, store, conflictPolicy, historyMode, verbosity)
+		} else {
+			// Get list of bugs.
+			bugs = loadBugs(archive, verbosity, maxBugs, rootUrl)
+			summaryReport.AddBugs(bugs, state, "APSIMInitiative", "APSIMClassic")
+			// Bugs which were posted by a previous (failed/aborted) run are skipped.
+			var remaining []Bug
+			for _, bug := range bugs {
+				if _, ok := state.Bugs[bug.id]; !ok {
+					remaining = append(remaining, bug)
+				}
+			}
+			postProgress = newProgress("Posting bugs", countPostCalls(remaining, historyMode), verbosity)
+			if store != nil {
+				downloadProgress = postProgress.Child("downloaded", countAttachments(remaining))
+				uploadProgress = postProgress.Child("uploaded", countAttachments(remaining))
+			}
+			for _, bug := range remaining {
+				postBug(bug, "APSIMInitiative", "APSIMClassic", "secret.txt", cacheDir, store, state, historyMode)
+				saveState(state)
+				// Lock the issue straight away, rather than leaving it open
+				// for replies until the end of the run.
+				lockMigratedIssue(bug.id, state, "APSIMInitiative", "APSIMClassic", "secret.txt", lockMode, lockReason)
+			}
+		}
+		if store != nil {
+			if err := store.Flush(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Lock issues which were migrated by earlier runs, or closed since.
+		lockMigratedIssues(bugs, state, "APSIMInitiative", "APSIMClassic", "secret.txt", lockMode, lockReason, verbosity)
+		if summary := postProgress.Finish(); verbosity > 0 && summary != "" {
+			fmt.Println(summary)
+		}
+		if store != nil {
+			downloaded, _ := downloadProgress.counts()
+			uploaded, _ := uploadProgress.counts()
+			fmt.Printf("Uploading attachments...Finished! %d downloaded, %d uploaded.\n", downloaded, uploaded)
+		} else {
+			fmt.Println("Uploading attachments...Finished!")
+		}
 		if verbosity > 1 {
 			
 			for _, bug := range bugs {
@@ -843,4 +1378,9 @@ func main() {
 			}
 		}
 	}
+	if summaryReport.file != "" {
+		summaryReport.Save()
+		fmt.Printf("Report written to %s\n", summaryReport.file)
+	}
+	runLog.Info(logContext{}, "Finished")
 }
\ No newline at end of file
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Gets some bugs to migrate: an open bug with a comment, and a closed bug.
+func testBugs() []Bug {
+	date := time.Date(2012, 3, 14, 9, 5, 0, 0, time.UTC)
+	return []Bug {
+		{
+			id: 1,
+			description: "Wheat yield is too low",
+			status: "1_New",
+			author: "hol353",
+			date: date,
+			comments: []Comment {
+				{ id: 11, author: "hol353", date: date, text: "Wheat yields are about half of what they should be." },
+				{ id: 12, author: "ver078", date: date.Add(time.Hour), text: "Confirmed." },
+			},
+		},
+		{
+			id: 2,
+			description: "Crash when loading a simulation",
+			status: "Closed",
+			author: "ver078",
+			date: date,
+			comments: []Comment {
+				{ id: 20, author: "ver078", date: date, text: "APSIM crashes." },
+			},
+		},
+	}
+}
+
+// Loads an empty migration state, which is saved in a temporary directory.
+func testState(t *testing.T) *migrationState {
+	state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestPostBug(t *testing.T) {
+	fake := startFakeGithub(t)
+	state := testState(t)
+	bugs := testBugs()
+	for _, bug := range bugs {
+		postBug(bug, "owner", "repo", "", "", nil, state, historyNone)
+	}
+
+	if fake.NumIssues() != 2 {
+		t.Fatalf("Expected 2 issues, but found %d", fake.NumIssues())
+	}
+	for i, bug := range bugs {
+		issue := fake.Issue(i + 1)
+		if issue.Title != bug.description || issue.Body != bug.ToString() {
+			t.Errorf("Issue #%d doesn't match bug #%d: %+v", issue.Number, bug.id, issue)
+		}
+		expectedState := "open"
+		if bug.IsClosed() {
+			expectedState = "closed"
+		}
+		if issue.State != expectedState {
+			t.Errorf("Expected issue #%d to be %s, but it's %s", issue.Number, expectedState, issue.State)
+		}
+	}
+	// The first comment is the body of the issue.
+	if comments := fake.CommentBodies(1); len(comments) != 1 || comments[0] != bugs[0].comments[1].ToString() {
+		t.Errorf("Unexpected comments on issue #1: %q", comments)
+	}
+	if comments := fake.CommentBodies(2); len(comments) != 0 {
+		t.Errorf("Unexpected comments on issue #2: %q", comments)
+	}
+
+	// The state is saved as the bugs are posted.
+	saved, err := loadState(state.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Bugs[1].Issue != 1 || saved.Bugs[1].FindComment(12) == nil || saved.Bugs[2].IssueState != "closed" {
+		t.Errorf("Unexpected migration state: %+v %+v", saved.Bugs[1], saved.Bugs[2])
+	}
+}
+
+func TestPostBugAbuseDetection(t *testing.T) {
+	fake := startFakeGithub(t)
+	// Every third issue or comment is rejected by the abuse detection, and
+	// has to be retried.
+	fake.abuseEvery = 3
+	state := testState(t)
+	for _, bug := range testBugs() {
+		postBug(bug, "owner", "repo", "", "", nil, state, historyNone)
+	}
+	if fake.NumIssues() != 2 || len(fake.CommentBodies(1)) != 1 {
+		t.Errorf("Expected 2 issues and 1 comment, but found %d issues and %d comments", fake.NumIssues(), len(fake.CommentBodies(1)))
+	}
+	if fake.Issue(2).State != "closed" {
+		t.Errorf("Expected issue #2 to be closed")
+	}
+}
+
+func TestGetGithubIssues(t *testing.T) {
+	fake := startFakeGithub(t)
+	for i := 0; i < fakeGithubPageSize + 5; i++ {
+		fake.AddIssue("Issue", "Legacy Bug ID: 1", "open")
+	}
+	issues := getGithubIssues("owner", "repo", "", "all", -1, 0)
+	if len(issues) != fakeGithubPageSize + 5 {
+		t.Fatalf("Expected %d issues, but found %d", fakeGithubPageSize + 5, len(issues))
+	}
+	if issues[0].Number != fakeGithubPageSize + 5 || !strings.Contains(issues[0].Body, "Legacy Bug ID") {
+		t.Errorf("Expected the newest issue first, but got %+v", issues[0])
+	}
+}
+
+// Starts a fake FTP server whose web root is the APSIM directory.
+// Returns the server and the directory in which it stores files.
+func startFakeFtp(t *testing.T) (*fakeFtp, string) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "APSIM"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	server, err := newFakeFtp(root, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, root
+}
+
+// Writes a local file to upload.
+// name: Name of the file.
+// contents: Contents of the file.
+func writeTestFile(t *testing.T, name, contents string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Checks the contents of a file.
+// file: Path of the file.
+// expected: Expected contents.
+func checkFile(t *testing.T, file, expected string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected %s to contain %q, but it contains %q", file, expected, string(data))
+	}
+}
+
+func TestUploadFileFtp(t *testing.T) {
+	server, root := startFakeFtp(t)
+	host, port := server.Addr()
+	local := writeTestFile(t, "crash.png", "first")
+
+	// Each level of a nested directory is created.
+	url, err := uploadFileFtp(host, port, "APSIM", "BugAttachments/sha256/ab", local, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != host + "/BugAttachments/sha256/ab/crash.png" {
+		t.Errorf("Unexpected URL: %s", url)
+	}
+	checkFile(t, filepath.Join(root, "APSIM", "BugAttachments", "sha256", "ab", "crash.png"), "first")
+
+	// Uploading into existing directories overwrites the file.
+	if err = ioutil.WriteFile(local, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = uploadFileFtp(host, port, "APSIM", "BugAttachments/sha256/ab", local, "user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(root, "APSIM", "BugAttachments", "sha256", "ab", "crash.png"), "second")
+
+	// The store gives the URL a scheme, so that GitHub doesn't treat it as relative.
+	store := &ftpStore { host: host, port: port, webRoot: "APSIM", user: "user", pass: "pass" }
+	url, err = store.Upload("BugAttachments/12", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://" + host + "/BugAttachments/12/crash.png" {
+		t.Errorf("Unexpected URL: %s", url)
+	}
+}
+
+func TestUploadFileFtpReadOnly(t *testing.T) {
+	server, root := startFakeFtp(t)
+	host, port := server.Addr()
+	local := writeTestFile(t, "crash.png", "data")
+
+	server.readOnly = true
+	if _, err := uploadFileFtp(host, port, "APSIM", "BugAttachments/12", local, "user", "pass"); err == nil {
+		t.Error("Expected creating a directory on a read-only server to fail")
+	}
+
+	// Even if the directory exists, the file can't be stored.
+	if err := os.MkdirAll(filepath.Join(root, "APSIM", "BugAttachments", "12"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadFileFtp(host, port, "APSIM", "BugAttachments/12", local, "user", "pass"); err == nil {
+		t.Error("Expected uploading to a read-only server to fail")
+	}
+	if _, err := os.Stat(filepath.Join(root, "APSIM", "BugAttachments", "12", "crash.png")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file to be stored, but got %v", err)
+	}
+
+	if _, err := uploadFileFtp(host, port, "APSIM", "BugAttachments/12", local, "user", "wrong"); err == nil {
+		t.Error("Expected logging in with the wrong password to fail")
+	}
+}
+
+// An attachment store which records uploads without storing anything.
+type fakeStore struct {
+	uploads		[]string
+	// Number of uploads which have been flushed.
+	flushed		int
+	flushes		int
+	// Called when the store is flushed.
+	onFlush		func()
+}
+
+func (f *fakeStore) Upload(remoteDir, localFile string) (string, error) {
+	remotePath := remoteDir + "/" + filepath.Base(localFile)
+	f.uploads = append(f.uploads, remotePath)
+	return f.Url(remotePath), nil
+}
+
+func (f *fakeStore) Url(remotePath string) string {
+	return "https://example.com/" + remotePath
+}
+
+func (f *fakeStore) Flush() error {
+	f.flushes++
+	f.flushed = len(f.uploads)
+	if f.onFlush != nil {
+		f.onFlush()
+	}
+	return nil
+}
+
+func TestPostBugPublishesAttachments(t *testing.T) {
+	fake := startFakeGithub(t)
+	cacheDir := t.TempDir()
+	bug := Bug { id: 3, description: "Crash", author: "hol353", status: "1_New", comments: []Comment {
+		{ id: 30, author: "hol353", text: "It crashes." },
+		{ id: 31, author: "hol353", text: "Screenshot", attachments: []Attachment { { name: "crash.png" } } },
+		{ id: 32, author: "hol353", text: "Log", attachments: []Attachment { { name: "error log.txt" } } },
+	} }
+	// The attachments are already in the cache, so nothing is downloaded.
+	for _, comment := range bug.comments[1:] {
+		if err := os.MkdirAll(filepath.Join(cacheDir, strconv.Itoa(int(comment.id))), 0755); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(cacheDir, strconv.Itoa(int(comment.id)), comment.attachments[0].GetCleanFileName())
+		if err := ioutil.WriteFile(file, []byte(comment.attachments[0].name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inner := &fakeStore { onFlush: func() {
+		if fake.NumIssues() != 0 {
+			t.Errorf("Expected attachments to be published before the issue was posted")
+		}
+	} }
+	store, err := newContentAddressedStore(inner, filepath.Join(cacheDir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postBug(bug, "owner", "repo", "", cacheDir, store, nil, historyNone)
+	// All of the bug's attachments are published together.
+	if inner.flushes != 1 || inner.flushed != 2 {
+		t.Errorf("Expected one flush of 2 files, but got %d flushes of %d files", inner.flushes, inner.flushed)
+	}
+	comments := fake.CommentBodies(1)
+	if len(comments) != 2 || !strings.Contains(comments[0], "https://example.com/BugAttachments/sha256/") {
+		t.Errorf("Expected comments to link to the uploaded files, but got %q", comments)
+	}
+}
+
+func TestContentAddressedStoreManifest(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), manifestName)
+	file := writeTestFile(t, "crash.png", "png")
+	hash, err := hashFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := Attachment { name: "crash.png", hash: hash }
+	expected := "https://example.com/BugAttachments/sha256/" + hash + "/crash.png"
+
+	// Upload the file in two separate runs. The second run should find it in
+	// the manifest rather than uploading it again.
+	for run := 1; run <= 2; run++ {
+		inner := &fakeStore{}
+		store, err := newContentAddressedStore(inner, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			url, err := store.Upload(attachment, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url != expected {
+				t.Errorf("Run %d: expected URL %s, but got %s", run, expected, url)
+			}
+		}
+		if err = store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if expectedUploads := 2 - run; len(inner.uploads) != expectedUploads {
+			t.Errorf("Run %d: expected %d uploads, but got %v", run, expectedUploads, inner.uploads)
+		}
+	}
+	checkFile(t, manifest, hash + "  BugAttachments/sha256/" + hash + "/crash.png\n")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// The archive is a JSON snapshot of the bugs scraped from the bug tracker,
+// so that they can be inspected or reused without scraping the site again.
+// These types mirror Bug, Comment and Attachment, whose fields are unexported.
+
+type archiveFile struct {
+	// Max number of bugs which were scraped (the -n argument). Negative
+	// if all bugs were scraped.
+	Limit		int					`json:"limit"`
+	Bugs		[]archivedBug		`json:"bugs"`
+}
+
+type archivedBug struct {
+	Id			int64				`json:"id"`
+	Description	string				`json:"description"`
+	Priority	string				`json:"priority"`
+	Status		string				`json:"status"`
+	Project		string				`json:"project"`
+	Category	string				`json:"category"`
+	Author		string				`json:"author"`
+	Date		time.Time			`json:"date"`
+	DateText	string				`json:"dateText,omitempty"`
+	Assignee	string				`json:"assignee"`
+	Url			string				`json:"url,omitempty"`
+	Comments	[]archivedComment	`json:"comments"`
+	History		[]archivedEvent		`json:"history,omitempty"`
+	Related		[]archivedRelation	`json:"related,omitempty"`
+	Subscribers	[]string			`json:"subscribers,omitempty"`
+}
+
+type archivedComment struct {
+	Id			int64					`json:"id"`
+	Author		string					`json:"author"`
+	Date		time.Time				`json:"date"`
+	DateText	string					`json:"dateText,omitempty"`
+	Text		string					`json:"text"`
+	Attachments	[]archivedAttachment	`json:"attachments,omitempty"`
+}
+
+type archivedEvent struct {
+	Author		string		`json:"author"`
+	Date		time.Time	`json:"date"`
+	Field		string		`json:"field,omitempty"`
+	From		string		`json:"from,omitempty"`
+	To			string		`json:"to,omitempty"`
+	Text		string		`json:"text"`
+}
+
+type archivedRelation struct {
+	Id			int64		`json:"id"`
+	Comment		string		`json:"comment,omitempty"`
+	Direction	string		`json:"direction,omitempty"`
+}
+
+type archivedAttachment struct {
+	Name		string		`json:"name"`
+	Size		int64		`json:"size"`
+	Url			string		`json:"url"`
+	FileName	string		`json:"fileName"`
+}
+
+// Writes bugs to an archive file.
+// file: Path of the archive.
+// bugs: The bugs to be archived.
+// n: Max number of bugs which were scraped. Negative for unlimited.
+func saveArchive(file string, bugs []Bug, n int) error {
+	archive := make([]archivedBug, 0, len(bugs))
+	for _, bug := range bugs {
+		archived := archivedBug {
+			Id: bug.id,
+			Description: bug.description,
+			Priority: bug.priority,
+			Status: bug.status,
+			Project: bug.project,
+			Category: bug.category,
+			Author: bug.author,
+			Date: bug.date,
+			DateText: bug.dateText,
+			Assignee: bug.assignee,
+			Url: bug.url,
+			Subscribers: bug.subscribers,
+		}
+		for _, comment := range bug.comments {
+			archivedComment := archivedComment {
+				Id: comment.id,
+				Author: comment.author,
+				Date: comment.date,
+				DateText: comment.dateText,
+				Text: comment.text,
+			}
+			for _, attachment := range comment.attachments {
+				archivedComment.Attachments = append(archivedComment.Attachments, archivedAttachment {
+					Name: attachment.name,
+					Size: attachment.size,
+					Url: attachment.url,
+					FileName: attachment.fileName,
+				})
+			}
+			archived.Comments = append(archived.Comments, archivedComment)
+		}
+		for _, related := range bug.related {
+			archived.Related = append(archived.Related, archivedRelation { related.id, related.comment, related.direction })
+		}
+		for _, event := range bug.history {
+			archived.History = append(archived.History, archivedEvent {
+				Author: event.author,
+				Date: event.date,
+				Field: event.field,
+				From: event.from,
+				To: event.to,
+				Text: event.text,
+			})
+		}
+		archive = append(archive, archived)
+	}
+	data, err := json.MarshalIndent(archiveFile { Limit: n, Bugs: archive }, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// Reads bugs from an archive file. Also returns the max number of bugs
+// which were scraped into the archive (negative for unlimited).
+// file: Path of the archive.
+func loadArchive(file string) ([]Bug, int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	var archive archiveFile
+	if err = json.Unmarshal(data, &archive); err != nil {
+		return nil, 0, fmt.Errorf("Unable to read archive %s: %v", file, err)
+	}
+	bugs := make([]Bug, 0, len(archive.Bugs))
+	for _, archived := range archive.Bugs {
+		bug := Bug {
+			id: archived.Id,
+			description: archived.Description,
+			priority: archived.Priority,
+			status: archived.Status,
+			project: archived.Project,
+			category: archived.Category,
+			author: archived.Author,
+			date: archived.Date,
+			dateText: archived.DateText,
+			assignee: archived.Assignee,
+			url: archived.Url,
+			subscribers: archived.Subscribers,
+		}
+		for _, archivedComment := range archived.Comments {
+			comment := Comment {
+				id: archivedComment.Id,
+				author: archivedComment.Author,
+				date: archivedComment.Date,
+				dateText: archivedComment.DateText,
+				text: archivedComment.Text,
+			}
+			for _, attachment := range archivedComment.Attachments {
+				comment.attachments = append(comment.attachments, Attachment {
+					name: attachment.Name,
+					size: attachment.Size,
+					url: attachment.Url,
+					fileName: attachment.FileName,
+				})
+			}
+			bug.comments = append(bug.comments, comment)
+		}
+		for _, related := range archived.Related {
+			bug.related = append(bug.related, Relationship { related.Id, related.Comment, related.Direction })
+		}
+		for _, event := range archived.History {
+			bug.history = append(bug.history, HistoryEvent {
+				author: event.Author,
+				date: event.Date,
+				field: event.Field,
+				from: event.From,
+				to: event.To,
+				text: event.Text,
+			})
+		}
+		bugs = append(bugs, bug)
+	}
+	return bugs, archive.Limit, nil
+}
+
+// Scrapes bugs from the bug tracker website, saves them to the archive (if
+// one is given), and filters them. Excluded content is only archived if the
+// filter asks for it.
+// archive: Path of the archive. May be empty.
+// verbosity: level of verbosity.
+// n: Max number of bugs to fetch. Negative for unlimited.
+// url: Root URL of the bug tracker website.
+func scrapeBugs(archive string, verbosity, n int, url string) []Bug {
+	bugs := getBugs(verbosity, n, url)
+	keepExcluded := contentFilter != nil && contentFilter.keepExcluded
+	if archive != "" && keepExcluded {
+		if err := saveArchive(archive, bugs, n); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bugs = filterBugs(bugs, verbosity)
+	if archive != "" && !keepExcluded {
+		if err := saveArchive(archive, bugs, n); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return bugs
+}
+
+// Gets bugs from an archive if it exists, otherwise scrapes them from the
+// bug tracker website (and saves them to the archive, if one is given).
+// Either way, the bugs are filtered.
+// archive: Path of the archive. May be empty.
+// verbosity: level of verbosity.
+// n: Max number of bugs to fetch. Negative for unlimited.
+// url: Root URL of the bug tracker website.
+func loadBugs(archive string, verbosity, n int, url string) []Bug {
+	if archive != "" {
+		if _, err := os.Stat(archive); err == nil {
+			if verbosity > 0 {
+				fmt.Printf("Reading bugs from %s\n", archive)
+			}
+			bugs, limit, err := loadArchive(archive)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// Otherwise -n would be silently ignored, or a partial archive
+			// would be mistaken for the whole bug tracker.
+			if limit != n && (limit >= 0 || n >= 0) {
+				log.Fatal(fmt.Sprintf("Error: %s was scraped with a different -n argument. Delete it to scrape the bugs again.", archive))
+			}
+			return filterBugs(bugs, verbosity)
+		}
+	}
+	return scrapeBugs(archive, verbosity, n, url)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bugs.json")
+	bugs := testBugs()
+	bugs[0].comments[1].attachments = []Attachment { { name: "crash log.txt", size: 300, url: "https://example.com/a", fileName: "crash_log.txt" } }
+	if err := saveArchive(file, bugs, 3); err != nil {
+		t.Fatal(err)
+	}
+	loaded, limit, err := loadArchive(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != 3 {
+		t.Errorf("Expected the archive's limit to be 3, but it was %d", limit)
+	}
+	if !reflect.DeepEqual(loaded, bugs) {
+		t.Errorf("Expected %+v, but got %+v", bugs, loaded)
+	}
+}
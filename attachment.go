@@ -1,61 +1,365 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 type Attachment struct {
 	name		string
 	size		int64
 	url			string
+	// Name under which the file is stored. Safe to use on disk and in URLs.
+	fileName	string
+	// SHA-256 hash of the downloaded file. Empty until the file is downloaded.
+	hash		string
+	// MIME type of the file. Sniffed from the file's contents once it has been
+	// downloaded, otherwise guessed from its extension.
+	mimeType	string
+	// URL of a thumbnail of the image. Empty if there is no thumbnail.
+	thumbnailUrl	string
 }
 
+// Renders the attachment as Markdown. Images are embedded (via their
+// thumbnail if they have one), and other files are rendered as a link.
 func (a *Attachment) ToString() string {
 	var str strings.Builder
 	
-	str.WriteString(fmt.Sprintf("[%v](%v)\n", a.name, a.url))
-	str.WriteString(fmt.Sprintf("Size: %d", a.size))
-	return str.String()
+	name := escapeMarkdown(a.name)
+	url := escapeMarkdownUrl(a.url)
+	if a.IsImage() && a.thumbnailUrl != "" {
+		str.WriteString(fmt.Sprintf("[![%v](%v)](%v)\n", name, escapeMarkdownUrl(a.thumbnailUrl), url))
+	} else if a.IsImage() {
+		str.WriteString(fmt.Sprintf("![%v](%v)\n", name, url))
+	} else {
+		str.WriteString(fmt.Sprintf("[%v](%v)\n", name, url))
+	}
+	var details []string
+	if a.size > 0 {
+		details = append(details, "Size: " + formatSize(a.size))
+	}
+	// The type of an embedded image is obvious, and an unknown type says nothing.
+	if mimeType := a.GetMimeType(); !a.IsImage() && mimeType != "application/octet-stream" {
+		details = append(details, "Type: " + mimeType)
+	}
+	str.WriteString(strings.Join(details, ", "))
+	return strings.TrimSuffix(str.String(), "\n")
+}
+
+// Gets the MIME type of the attachment.
+func (a *Attachment) GetMimeType() string {
+	if a.mimeType != "" {
+		return a.mimeType
+	}
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(a.name))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Checks if the attachment is an image which can be displayed inline. SVGs
+// are linked rather than embedded, as they can contain scripts.
+func (a *Attachment) IsImage() bool {
+	switch strings.Split(a.GetMimeType(), ";")[0] {
+	case "image/png", "image/jpeg", "image/gif", "image/bmp", "image/webp":
+		return true
+	}
+	return false
 }
 
-// Downloads a file at a given URL.
+// Sets the attachment's MIME type by sniffing the contents of a downloaded copy.
+// localFile: Path to the downloaded file.
+func (a *Attachment) detectMimeType(localFile string) error {
+	file, err := os.Open(localFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	a.mimeType = http.DetectContentType(buffer[:n])
+	
+	// Text and unrecognised binary formats are better identified by extension.
+	if strings.HasPrefix(a.mimeType, "text/plain") || a.mimeType == "application/octet-stream" {
+		if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(a.name))); t != "" && !strings.HasPrefix(t, "image/") {
+			a.mimeType = t
+		}
+	}
+	return nil
+}
+
+// Formats a file size in human-readable units (e.g. 1.5 MiB).
+// size: Size in bytes.
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	value := float64(size)
+	units := []string { "KiB", "MiB", "GiB", "TiB" }
+	unit := ""
+	for _, u := range units {
+		value /= 1024
+		unit = u
+		if value < 1024 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
+// Maximum number of times a download will be attempted before giving up.
+const maxDownloadAttempts = 6
+
+// An error encountered while downloading an attachment.
+type downloadError struct {
+	url			string
+	message		string
+	// True if the download might succeed if it is attempted again.
+	retryable	bool
+}
+
+func (e *downloadError) Error() string {
+	return fmt.Sprintf("Unable to download %s: %s", e.url, e.message)
+}
+
+// Downloads a file at a given URL, and records its SHA-256 hash.
+// Data is downloaded into path.part, and a previous partial download is
+// resumed if the server supports range requests. The download is rejected if
+// the server returns an error, or if the size of the file doesn't match the
+// size reported by the bug tracker.
 // path: path to where the file will be downloaded.
 // url: URL of the file.
 func (a *Attachment) downloadFile(path string, url string) (string, error) {
-	// Create the file.
-	out, err := os.Create(path)
+	partial := path + ".part"
+	out, err := os.OpenFile(partial, os.O_CREATE | os.O_WRONLY, 0644)
 	if err != nil {
 		return "", err
 	}
 	defer out.Close()
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
 	
-	// Download the file.
-	response, err := http.Get(url)
+	// Download the file, asking only for the missing part if we already have some of it.
+	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", err
 	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", &downloadError { url: url, message: err.Error(), retryable: true }
+	}
 	defer response.Body.Close()
 	
+	switch {
+	case response.StatusCode == http.StatusPartialContent:
+		// Server is sending the remainder of the file.
+	case response.StatusCode == http.StatusOK:
+		// Server is sending the whole file, so discard anything we already have.
+		if err = out.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err = out.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && offset == a.size:
+		// We already have the whole file.
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && a.size <= 0 && rangeLength(response) == offset:
+		// The bug tracker didn't report the size, but the server says we
+		// already have the whole file.
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file doesn't match the file on the server, so start
+		// again from scratch.
+		out.Close()
+		os.Remove(partial)
+		return "", &downloadError { url: url, message: "server rejected the request to resume the download", retryable: true }
+	default:
+		return "", &downloadError { url: url, message: "server returned " + response.Status, retryable: response.StatusCode >= 500 }
+	}
+	
 	// Write the downloaded data to the file.
-	_, err = io.Copy(out, response.Body)
+	if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err = io.Copy(out, response.Body); err != nil {
+			return "", &downloadError { url: url, message: err.Error(), retryable: true }
+		}
+	}
+	written, err := out.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return "", err
 	}
-	return path, nil
+	if a.size > 0 && written != a.size {
+		// The partial file can't be trusted, so start again from scratch next time.
+		out.Close()
+		os.Remove(partial)
+		message := fmt.Sprintf("expected %d bytes but received %d", a.size, written)
+		return "", &downloadError { url: url, message: message, retryable: true }
+	}
+	if err = out.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(partial, path); err != nil {
+		return "", err
+	}
+	a.hash, err = hashFile(path)
+	return path, err
+}
+
+// Gets the length of a file from the Content-Range header of a response to a
+// range request (e.g. "bytes */1234"), or -1 if the length isn't known.
+// response: The response.
+func rangeLength(response *http.Response) int64 {
+	contentRange := response.Header.Get("Content-Range")
+	slash := strings.LastIndex(contentRange, "/")
+	if slash < 0 {
+		return -1
+	}
+	length, err := strconv.ParseInt(contentRange[slash + 1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return length
+}
+
+// Computes the SHA-256 hash of a file.
+// path: Path to the file.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 // Gets the sanitised filename.
 func (a *Attachment) GetCleanFileName() string {
-	return strings.Replace(a.name, " ", "_", -1)
+	if a.fileName != "" {
+		return a.fileName
+	}
+	return sanitiseFileName(a.name)
+}
+
+// Maximum length of a sanitised file name.
+const maxFileNameLength = 100
+
+// Matches names which Windows reserves for devices, with or without an
+// extension (e.g. "CON" or "nul.txt").
+var reservedFileName = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[1-9]|lpt[1-9])(\.|$)`)
+
+// Converts a file name into one which is safe to use on disk, in an FTP path,
+// and in a URL. Any directory components are removed, and anything other than
+// ASCII letters, digits, '.', '-' and '_' is replaced by an underscore.
+// Names reserved by Windows are prefixed with an underscore.
+// name: The original file name.
+func sanitiseFileName(name string) string {
+	// Only keep the final component of any path (e.g. "../../foo.txt").
+	name = name[strings.LastIndexAny(name, `/\`) + 1:]
+	
+	var str strings.Builder
+	for _, r := range name {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_') {
+			str.WriteRune(r)
+		} else {
+			str.WriteRune('_')
+		}
+	}
+	
+	// Leading dots would make the file hidden (or refer to a parent directory),
+	// and trailing dots are stripped by Windows.
+	clean := strings.Trim(str.String(), ".")
+	if strings.Trim(strings.TrimSuffix(clean, filepath.Ext(clean)), "_") == "" {
+		clean = "attachment" + clean
+	}
+	if reservedFileName.MatchString(clean) {
+		clean = "_" + clean
+	}
+	if len(clean) > maxFileNameLength {
+		ext := filepath.Ext(clean)
+		if len(ext) > maxFileNameLength / 2 {
+			ext = ""
+		}
+		clean = clean[:maxFileNameLength - len(ext)] + ext
+	}
+	return clean
 }
 
-// Downlaods the attachment to a given directory.
+// Makes a file name unique by appending a number to it if necessary.
+// name: The file name.
+// taken: Names which have already been used. The returned name is added to this set.
+func uniqueFileName(name string, taken map[string]bool) string {
+	unique := name
+	ext := filepath.Ext(name)
+	for i := 2; taken[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	taken[strings.ToLower(unique)] = true
+	return unique
+}
+
+// Escapes characters which have special meaning in Markdown link text.
+// text: The text to be escaped.
+func escapeMarkdown(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`, "`", "\\`", "<", "&lt;", ">", "&gt;")
+	return replacer.Replace(text)
+}
+
+// Escapes characters which would terminate or break the destination of a
+// Markdown link.
+// url: The URL to be escaped.
+func escapeMarkdownUrl(url string) string {
+	replacer := strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "<", "%3C", ">", "%3E")
+	return replacer.Replace(url)
+}
+
+// Downloads the attachment to a given directory, unless it has already
+// been downloaded there. Failed downloads are retried with exponential backoff.
 // dir: File will be downloaded to this directory.
-func (a *Attachment) Download(dir string) (string, error) {
-	return a.downloadFile(path.Join(dir, a.GetCleanFileName()), a.url)
+// context: Bug and comment to which the attachment belongs, for logging.
+func (a *Attachment) Download(dir string, context logContext) (string, error) {
+	CreateDirIfNotExist(dir)
+	file := path.Join(dir, a.GetCleanFileName())
+	if info, err := os.Stat(file); err == nil && (a.size <= 0 || info.Size() == a.size) {
+		a.hash, err = hashFile(file)
+		return file, err
+	}
+	
+	for attempt := 1; ; attempt++ {
+		_, err := a.downloadFile(file, a.url)
+		if err == nil {
+			return file, nil
+		}
+		if e, ok := err.(*downloadError); !ok || !e.retryable || attempt >= maxDownloadAttempts {
+			return "", err
+		}
+		delay := time.Duration(1 << uint(attempt - 1)) * time.Second + time.Duration(rand.Intn(1000)) * time.Millisecond
+		fmt.Printf("%v (attempt %d of %d). Retrying in %v...\n", err, attempt, maxDownloadAttempts, delay.Round(time.Second))
+		runLog.Warn(context, "Downloading %s failed: %v (attempt %d of %d). Retrying in %v", a.url, err, attempt, maxDownloadAttempts, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
 }
\ No newline at end of file
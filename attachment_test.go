@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileResume(t *testing.T) {
+	contents := []byte("0123456789")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handles range requests like a real server.
+		http.ServeContent(w, r, "log.txt", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name		string
+		// Contents of the partial download.
+		partial		string
+		// Size reported by the bug tracker. 0 if unknown.
+		size		int64
+		// True if the first attempt should fail, but the second succeed.
+		retry		bool
+	}{
+		{ "no partial download", "", 0, false },
+		{ "half downloaded", "01234", 0, false },
+		{ "fully downloaded", "0123456789", 10, false },
+		{ "fully downloaded, size unknown", "0123456789", 0, false },
+		{ "partial download is too long", "0123456789abc", 0, true },
+	}
+	for _, test := range tests {
+		file := filepath.Join(t.TempDir(), "log.txt")
+		if test.partial != "" {
+			if err := ioutil.WriteFile(file + ".part", []byte(test.partial), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a := Attachment { name: "log.txt", size: test.size }
+		_, err := a.downloadFile(file, server.URL)
+		if test.retry {
+			if e, ok := err.(*downloadError); !ok || !e.retryable {
+				t.Errorf("%s: expected a retryable error, but got %v", test.name, err)
+			}
+			if _, err = os.Stat(file + ".part"); !os.IsNotExist(err) {
+				t.Errorf("%s: expected the partial download to be deleted", test.name)
+			}
+			_, err = a.downloadFile(file, server.URL)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		checkFile(t, file, string(contents))
+	}
+}
+
+func TestAttachmentToString(t *testing.T) {
+	tests := []struct {
+		attachment	Attachment
+		expected	string
+	}{
+		{ Attachment { name: "crash.png", size: 2048, url: "https://example.com/crash.png" }, "![crash.png](https://example.com/crash.png)\nSize: 2.0 KiB" },
+		{ Attachment { name: "crash.png", url: "https://example.com/crash.png", thumbnailUrl: "https://example.com/thumb.png" }, "[![crash.png](https://example.com/thumb.png)](https://example.com/crash.png)" },
+		// SVGs can contain scripts, so they're linked rather than embedded.
+		{ Attachment { name: "plot.svg", size: 300, url: "https://example.com/plot.svg" }, "[plot.svg](https://example.com/plot.svg)\nSize: 300 bytes, Type: image/svg+xml" },
+		{ Attachment { name: "sim.apsim", size: 300, url: "https://example.com/sim.apsim", mimeType: "text/xml; charset=utf-8" }, "[sim.apsim](https://example.com/sim.apsim)\nSize: 300 bytes, Type: text/xml; charset=utf-8" },
+		{ Attachment { name: "data.bin", url: "https://example.com/data.bin", mimeType: "application/octet-stream" }, "[data.bin](https://example.com/data.bin)" },
+	}
+	for _, test := range tests {
+		if actual := test.attachment.ToString(); actual != test.expected {
+			t.Errorf("Expected %q, but got %q", test.expected, actual)
+		}
+	}
+}
+
+func TestSanitiseFileName(t *testing.T) {
+	long := strings.Repeat("a", 150)
+	tests := []struct {
+		name		string
+		expected	string
+	}{
+		{ "crash report.png", "crash_report.png" },
+		// Directory components are removed, whichever separator is used.
+		{ "../../etc/passwd", "passwd" },
+		{ "/etc/passwd", "passwd" },
+		{ `..\..\Windows\win.ini`, "win.ini" },
+		{ `C:\Users\me\sim.apsim`, "sim.apsim" },
+		{ "..", "attachment" },
+		{ ".hidden", "hidden" },
+		// Characters reserved by Windows.
+		{ `a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt" },
+		{ "trailing.", "trailing" },
+		// Names reserved by Windows.
+		{ "CON", "_CON" },
+		{ "nul.txt", "_nul.txt" },
+		{ "com1.log", "_com1.log" },
+		{ "console.txt", "console.txt" },
+		// Non-ASCII text.
+		{ "résumé.doc", "r_sum_.doc" },
+		{ "日本語.txt", "attachment___.txt" },
+		// Long names are truncated, keeping the extension.
+		{ long + ".txt", long[:maxFileNameLength - 4] + ".txt" },
+		{ "a." + long, ("a." + long)[:maxFileNameLength] },
+	}
+	for _, test := range tests {
+		if actual := sanitiseFileName(test.name); actual != test.expected {
+			t.Errorf("sanitiseFileName(%q): expected %q, but got %q", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestAssignFileNames(t *testing.T) {
+	comment := Comment { attachments: []Attachment {
+		{ name: "output.txt" },
+		{ name: "output.txt" },
+		{ name: "OUTPUT.TXT" },
+		{ name: "dir/output.txt" },
+		{ name: "output_2.txt" },
+	} }
+	comment.assignFileNames()
+	expected := []string { "output.txt", "output_2.txt", "OUTPUT_3.TXT", "output_4.txt", "output_2_2.txt" }
+	for i, attachment := range comment.attachments {
+		if attachment.GetCleanFileName() != expected[i] {
+			t.Errorf("Attachment %d: expected file name %q, but got %q", i, expected[i], attachment.GetCleanFileName())
+		}
+		// The original name is still shown in the link text.
+		if !strings.Contains(attachment.ToString(), "[" + escapeMarkdown(attachment.name) + "]") {
+			t.Errorf("Attachment %d: expected the link text to show the original name %q, but got %q", i, attachment.name, attachment.ToString())
+		}
+	}
+}
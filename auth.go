@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A source of GitHub access tokens.
+type tokenSource interface {
+	// Gets a token with which to authenticate the next request.
+	Token() (string, error)
+}
+
+// A personal access token.
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// Authenticates as a GitHub App installation. Installation tokens expire
+// after an hour, so they are refreshed automatically.
+type appTokenSource struct {
+	appId			string
+	installationId	string
+	key				*rsa.PrivateKey
+
+	mutex			sync.Mutex
+	token			string
+	expires			time.Time
+}
+
+// Creates a token source for a GitHub App installation.
+// appId: ID of the GitHub App.
+// installationId: ID of the app's installation on the target repo/organisation.
+// keyFile: Path to the app's private key (PEM format).
+func newAppTokenSource(appId, installationId, keyFile string) (*appTokenSource, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", keyFile)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("Private key in %s is not an RSA key", keyFile)
+		}
+	}
+	return &appTokenSource { appId: appId, installationId: installationId, key: key }, nil
+}
+
+// Gets the installation token, requesting a new one if it's about to expire.
+func (a *appTokenSource) Token() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.token != "" && time.Until(a.expires) > 5 * time.Minute {
+		return a.token, nil
+	}
+
+	jwt, err := a.createJwt()
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("%sapp/installations/%s/access_tokens", githubApiUrl, a.installationId)
+	request, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	request.Header.Set("Authorization", "Bearer " + jwt)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(response.Body)
+		return "", fmt.Errorf("Unable to get installation token for GitHub App %s: %s\n%s", a.appId, response.Status, body)
+	}
+
+	var result struct {
+		Token		string		`json:"token"`
+		ExpiresAt	time.Time	`json:"expires_at"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	a.token = result.Token
+	a.expires = result.ExpiresAt
+	return a.token, nil
+}
+
+// Creates a JSON Web Token with which the app authenticates itself when
+// requesting an installation token.
+func (a *appTokenSource) createJwt() (string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	now := time.Now()
+	header := encode([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	// Backdate the token slightly in case our clock is ahead of GitHub's.
+	claims, err := json.Marshal(map[string]interface{} {
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.appId,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + encode(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encode(signature), nil
+}
+
+// A set of token sources, each with its own rate limit. Requests use one
+// source until its rate limit is exhausted, then move on to the next.
+type tokenPool struct {
+	sources		[]tokenSource
+	// Time at which the rate limit of each source resets.
+	resets		[]time.Time
+	current		int
+	mutex		sync.Mutex
+}
+
+// Creates a token pool.
+// sources: The token sources, in order of preference.
+func newTokenPool(sources ...tokenSource) *tokenPool {
+	return &tokenPool { sources: sources, resets: make([]time.Time, len(sources)) }
+}
+
+// Gets the source which should be used for the next request, and its token.
+func (p *tokenPool) Next() (int, string, error) {
+	if len(p.sources) == 0 {
+		return 0, "", fmt.Errorf("No GitHub access tokens have been configured")
+	}
+	p.mutex.Lock()
+	current := p.current
+	p.mutex.Unlock()
+	token, err := p.sources[current].Token()
+	return current, token, err
+}
+
+// Records that a source's rate limit is exhausted, and switches to another
+// source if one is available. Returns true if the pool switched sources.
+// source: Index of the exhausted source.
+// reset: Time at which its rate limit resets.
+func (p *tokenPool) Exhausted(source int, reset time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.resets[source] = reset
+	for i := 1; i < len(p.sources); i++ {
+		next := (source + i) % len(p.sources)
+		if time.Now().After(p.resets[next]) {
+			p.current = next
+			return true
+		}
+	}
+	return false
+}
+
+// Splits the contents of a secret into tokens. Tokens may be separated by
+// commas or newlines, and blank lines and # comments are ignored.
+// secret: The secret.
+func splitTokens(secret string) (tokens []tokenSource) {
+	for _, line := range strings.Split(secret, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, token := range strings.Split(line, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, staticToken(token))
+			}
+		}
+	}
+	return
+}
+
+// Reads tokens from an environment variable.
+// name: Name of the environment variable.
+func getTokensFromEnv(name string) ([]tokenSource, error) {
+	tokens := splitTokens(os.Getenv(name))
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Environment variable %s does not contain a GitHub token", name)
+	}
+	return tokens, nil
+}
+
+// Reads tokens from the output of a credential helper command (e.g.
+// "gh auth token" or a password manager).
+// command: The command, which is run by the shell.
+func getTokensFromCommand(command string) ([]tokenSource, error) {
+	output, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Credential helper \"%s\" failed: %v", command, err)
+	}
+	tokens := splitTokens(string(output))
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Credential helper \"%s\" did not output a GitHub token", command)
+	}
+	return tokens, nil
+}
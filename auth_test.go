@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes an RSA private key to a PEM file.
+// key: The key.
+// pkcs8: If true, the key is written in PKCS8 format. Otherwise PKCS1.
+func writeTestKey(t *testing.T, key *rsa.PrivateKey, pkcs8 bool) string {
+	block := &pem.Block { Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key) }
+	if pkcs8 {
+		data, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block { Type: "PRIVATE KEY", Bytes: data }
+	}
+	file := filepath.Join(t.TempDir(), "app.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCreateJwt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkcs8 := range []bool { false, true } {
+		source, err := newAppTokenSource("1234", "5678", writeTestKey(t, key, pkcs8))
+		if err != nil {
+			t.Fatalf("PKCS8 %v: %v", pkcs8, err)
+		}
+		jwt, err := source.createJwt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			t.Fatalf("Expected a JWT with 3 parts, but got %s", jwt)
+		}
+
+		// The signature must verify against the public key.
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature); err != nil {
+			t.Errorf("PKCS8 %v: invalid signature: %v", pkcs8, err)
+		}
+
+		var header map[string]string
+		var claims struct {
+			Iat		int64	`json:"iat"`
+			Exp		int64	`json:"exp"`
+			Iss		string	`json:"iss"`
+		}
+		for i, value := range []interface{} { &header, &claims } {
+			data, err := base64.RawURLEncoding.DecodeString(parts[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal(data, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if header["alg"] != "RS256" || header["typ"] != "JWT" {
+			t.Errorf("Unexpected header: %v", header)
+		}
+		// GitHub rejects tokens which expire more than 10 minutes after they're issued.
+		now := time.Now().Unix()
+		if claims.Iss != "1234" || claims.Iat > now || claims.Exp <= now || claims.Exp - claims.Iat > 600 {
+			t.Errorf("Unexpected claims: %+v", claims)
+		}
+	}
+}
+
+func TestAppToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != "POST" || r.URL.Path != "/app/installations/5678/access_tokens" || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"token-%d","expires_at":"%s"}`, requests, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer server.Close()
+	original := githubApiUrl
+	githubApiUrl = server.URL + "/"
+	defer func() { githubApiUrl = original }()
+
+	source, err := newAppTokenSource("1234", "5678", writeTestKey(t, key, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if token, err := source.Token(); err != nil || token != "token-1" {
+			t.Errorf("Expected the first token to be reused, but got %s (%v)", token, err)
+		}
+	}
+	// Tokens are refreshed shortly before they expire.
+	source.expires = time.Now().Add(time.Minute)
+	if token, err := source.Token(); err != nil || token != "token-2" {
+		t.Errorf("Expected a new token, but got %s (%v)", token, err)
+	}
+}
+
+func TestNewAppTokenSourceInvalidKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.pem")
+	if err := ioutil.WriteFile(file, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAppTokenSource("1234", "5678", file); err == nil {
+		t.Error("Expected a file without a key to be rejected")
+	}
+}
+
+func TestTokenPool(t *testing.T) {
+	pool := newTokenPool(staticToken("a"), staticToken("b"), staticToken("c"))
+	next := func() string {
+		_, token, err := pool.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	if token := next(); token != "a" {
+		t.Errorf("Expected the first token, but got %s", token)
+	}
+
+	// Exhausting a token moves on to the next one.
+	reset := time.Now().Add(time.Hour)
+	if !pool.Exhausted(0, reset) || next() != "b" {
+		t.Error("Expected to switch to the second token")
+	}
+	if !pool.Exhausted(1, reset) || next() != "c" {
+		t.Error("Expected to switch to the third token")
+	}
+	// Every token is exhausted until the reset, so there's nothing to switch to.
+	if pool.Exhausted(2, reset) {
+		t.Error("Expected not to switch when every token is exhausted")
+	}
+	if token := next(); token != "c" {
+		t.Errorf("Expected to keep using the last token, but got %s", token)
+	}
+
+	// Once a token's limit has reset, it can be used again.
+	pool.resets[0] = time.Now().Add(-time.Second)
+	if !pool.Exhausted(2, reset) || next() != "a" {
+		t.Error("Expected to switch back to the first token once it had reset")
+	}
+
+	if _, _, err := newTokenPool().Next(); err == nil {
+		t.Error("Expected an error from an empty pool")
+	}
+}
+
+func TestSplitTokens(t *testing.T) {
+	tests := map[string][]tokenSource {
+		"abc": { staticToken("abc") },
+		" abc \n\ndef\n": { staticToken("abc"), staticToken("def") },
+		"abc, def,,ghi": { staticToken("abc"), staticToken("def"), staticToken("ghi") },
+		"# Work account\nabc\n  # old: xyz\n": { staticToken("abc") },
+		"": nil,
+	}
+	for secret, expected := range tests {
+		if actual := splitTokens(secret); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %q to be split into %v, but got %v", secret, expected, actual)
+		}
+	}
+}
+
+func TestGetTokensFromEnv(t *testing.T) {
+	const name = "TRANSFER_ISSUES_TEST_TOKENS"
+	defer os.Unsetenv(name)
+	os.Setenv(name, "abc,def")
+	tokens, err := getTokensFromEnv(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []tokenSource { staticToken("abc"), staticToken("def") }; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected %v, but got %v", expected, tokens)
+	}
+	os.Setenv(name, " \n# none\n")
+	if _, err = getTokensFromEnv(name); err == nil {
+		t.Error("Expected an error when the variable has no tokens")
+	}
+}
+
+func TestGetTokensFromCommand(t *testing.T) {
+	tokens, err := getTokensFromCommand("printf 'abc\\ndef\\n'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []tokenSource { staticToken("abc"), staticToken("def") }; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected %v, but got %v", expected, tokens)
+	}
+	if _, err = getTokensFromCommand("true"); err == nil {
+		t.Error("Expected an error when the command outputs no tokens")
+	}
+	if _, err = getTokensFromCommand("exit 1"); err == nil {
+		t.Error("Expected an error when the command fails")
+	}
+}
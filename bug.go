@@ -15,16 +15,26 @@ type Bug struct {
 	category		string
 	author			string
 	date			time.Time
+	// The date as it appeared on the bug tracker.
+	dateText		string
 	assignee 		string
 	comments		[]Comment
+	// Changes made to the bug, oldest first.
+	history			[]HistoryEvent
+	related			[]Relationship
+	// Usernames of the people subscribed to the bug.
+	subscribers		[]string
+	// URL of the bug on the bug tracker website.
+	url				string
 }
 
 func (b *Bug) ToString() string {
 	var str strings.Builder
 	
+	str.WriteString(b.Banner())
 	str.WriteString(fmt.Sprintf("Legacy Bug ID: %d\n", b.id))
 	str.WriteString(fmt.Sprintf("Author: %v\n", b.author))
-	str.WriteString(fmt.Sprintf("Date: %v\n", b.date))
+	str.WriteString(fmt.Sprintf("Date: %v\n", formatLegacyDate(b.date, b.dateText)))
 	//str.WriteString(fmt.Sprintf("Title: %v\n\n", b.description))
 	str.WriteString(fmt.Sprintf("Status: %s\n", b.status))
 	if len(b.comments) > 0 {
@@ -34,6 +44,41 @@ func (b *Bug) ToString() string {
 	return str.String()
 }
 
+// Computes a hash of the fields of the bug which appear in the issue, for
+// detecting edits. The hash is taken from the bug itself rather than the
+// issue body, so that changes to the way issues are written don't make every
+// issue look as if it has been edited.
+func (b *Bug) Hash() string {
+	var str strings.Builder
+	str.WriteString(fmt.Sprintf("%s\n%s\n%s\n%s", b.description, b.author, b.dateText, b.status))
+	if len(b.comments) > 0 {
+		str.WriteString("\n" + b.comments[0].text)
+	}
+	return hashText(str.String())
+}
+
+// Renders a date from the bug tracker in an unambiguous format which
+// includes the UTC offset, e.g. 2012-03-14 09:05 +10:00. Dates which were
+// displayed without a time of day are rendered without one.
+// date: The parsed date.
+// original: The date as it appeared on the bug tracker.
+func formatLegacyDate(date time.Time, original string) string {
+	if original != "" && !strings.Contains(original, ":") {
+		return date.Format("2006-01-02")
+	}
+	return date.Format("2006-01-02 15:04 -07:00")
+}
+
+// Explains that the issue was imported from the legacy bug tracker, so that
+// people don't expect the original participants to see replies.
+func (b *Bug) Banner() string {
+	original := fmt.Sprintf("legacy bug %d", b.id)
+	if b.url != "" {
+		original = fmt.Sprintf("[%s](%s)", original, b.url)
+	}
+	return fmt.Sprintf("> This issue was imported from the legacy APSIM bug tracker (%s). Replies posted here will not be seen by the people who took part in the original discussion.\n\n", original)
+}
+
 func (b *Bug) ToLongString() string {
 	var str strings.Builder
 	
@@ -49,6 +94,8 @@ func (b *Bug) ToLongString() string {
 	return str.String()
 }
 
+// Checks if the bug is closed. Bugs awaiting review ("4_Review") count as
+// closed, since the fix has already been made.
 func (b *Bug) IsClosed() bool {
-	return strings.ToLower(b.status) == "closed" || strings.ToLower(b.status) == "4_Review"
+	return strings.EqualFold(b.status, "closed") || strings.EqualFold(b.status, "4_Review")
 }
\ No newline at end of file
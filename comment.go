@@ -10,19 +10,46 @@ type Comment struct {
 	id				int64
 	author			string
 	date			time.Time
+	// The date as it appeared on the bug tracker.
+	dateText		string
 	text			string
-	attachment		Attachment
+	attachments		[]Attachment
 }
 
 func (c *Comment) ToString() string {
 	var str strings.Builder
 	
 	str.WriteString(fmt.Sprintf("Author: %v\n", c.author))
-	str.WriteString(fmt.Sprintf("Date: %v\n\n", c.date))
-	if c.attachment == (Attachment{}) {
+	str.WriteString(fmt.Sprintf("Date: %v\n\n", formatLegacyDate(c.date, c.dateText)))
+	if len(c.attachments) == 0 {
 		str.WriteString(c.text)
 	} else {
-		str.WriteString(c.attachment.ToString())
+		for i, attachment := range c.attachments {
+			if i > 0 {
+				str.WriteString("\n\n")
+			}
+			str.WriteString(attachment.ToString())
+		}
 	}
 	return str.String()
+}
+
+// Computes a hash of the comment's contents, for detecting edits. Attachment
+// URLs are excluded because they change when the attachments are uploaded.
+func (c *Comment) Hash() string {
+	var str strings.Builder
+	str.WriteString(c.author + "\n" + c.text)
+	for _, attachment := range c.attachments {
+		str.WriteString(fmt.Sprintf("\n%s %d", attachment.name, attachment.size))
+	}
+	return hashText(str.String())
+}
+
+// Gives each attachment a sanitised file name which is unique within the
+// comment, so that attachments with the same name don't overwrite each other.
+func (c *Comment) assignFileNames() {
+	taken := make(map[string]bool)
+	for i := range c.attachments {
+		c.attachments[i].fileName = uniqueFileName(sanitiseFileName(c.attachments[i].name), taken)
+	}
 }
\ No newline at end of file
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"github.com/octokit/go-octokit/octokit"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An issue along with its comments.
+type issueWithComments struct {
+	issue		octokit.Issue
+	comments	[]octokit.IssueComment
+}
+
+// The comment posted on an issue which is closed as a duplicate.
+const duplicateNotice = "Duplicate of #%d. This issue was created more than once while migrating from the legacy bug tracker."
+
+// Matches the comment posted on an issue which was closed as a duplicate.
+var duplicateNoticePattern = regexp.MustCompile(`^Duplicate of #\d+\. This issue was created more than once`)
+
+// Matches the legacy bug ID in the body of an issue. Unlike getLegacyId,
+// this doesn't accept the "Bug #N" syntax used by older versions of this
+// program, since that also matches ordinary references to other bugs.
+var legacyIdLine = regexp.MustCompile(`(?m)^Legacy Bug ID: (\d+)\s*$`)
+
+// Finds issues which were created more than once for the same legacy bug
+// (e.g. by an interrupted run), and merges them. The issue with the most
+// migrated comments is kept, any comments which only exist on the other
+// issues are copied onto it in the order in which they were posted, and the
+// other issues are closed as duplicates. Issues are only grouped by their
+// legacy bug ID, and issues which were already closed as duplicates are
+// ignored, so running this again doesn't do anything. If the migration state
+// refers to a duplicate, it's pointed at the kept issue instead.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// state: The migration state.
+// dryRun: If true, report what would be done without changing anything.
+// verbosity: level of output detail.
+func dedupeIssues(owner, repo, credFile string, state *migrationState, dryRun bool, verbosity int) {
+	client := newGithubClient(credFile)
+	issues := getGithubIssues(owner, repo, credFile, "all", -1, verbosity)
+
+	groups := make(map[int64][]octokit.Issue)
+	var keys []int64
+	for _, issue := range issues {
+		matches := legacyIdLine.FindStringSubmatch(issue.Body)
+		if len(matches) < 2 {
+			if verbosity > 1 {
+				fmt.Printf("Skipping issue #%d: no legacy bug ID\n", issue.Number)
+			}
+			continue
+		}
+		key := parseInt(matches[1])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], issue)
+	}
+
+	numDuplicates := 0
+	for _, key := range keys {
+		if len(groups[key]) < 2 {
+			continue
+		}
+		var candidates []issueWithComments
+		for _, issue := range groups[key] {
+			candidate := issueWithComments { issue, getIssueComments(client, owner, repo, issue.Number) }
+			if isClosedDuplicate(candidate) {
+				if verbosity > 1 {
+					fmt.Printf("Skipping issue #%d: already closed as a duplicate\n", issue.Number)
+				}
+				continue
+			}
+			candidates = append(candidates, candidate)
+		}
+		if len(candidates) < 2 {
+			continue
+		}
+
+		// Keep the most complete issue. If there's a tie, keep the oldest.
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := countMigratedComments(candidates[i].comments), countMigratedComments(candidates[j].comments)
+			if a != b {
+				return a > b
+			}
+			return candidates[i].issue.Number < candidates[j].issue.Number
+		})
+		keep := candidates[0]
+		fmt.Printf("Keeping issue #%d (%d migrated comments) for bug #%d\n", keep.issue.Number, countMigratedComments(keep.comments), key)
+
+		// Collect the comments which are missing from the kept issue, so that
+		// they can be copied in the order in which they were originally posted.
+		// Also work out which comment on the kept issue corresponds to each
+		// comment on the duplicates, for updating the migration state.
+		existing := make(map[string]int)
+		for _, comment := range keep.comments {
+			existing[normaliseBody(comment.Body)] = comment.ID
+		}
+		type missingComment struct {
+			comment		octokit.IssueComment
+			from		int
+		}
+		var missing []missingComment
+		copies := make(map[int]int)
+		for _, duplicate := range candidates[1:] {
+			for _, comment := range duplicate.comments {
+				if duplicateNoticePattern.MatchString(comment.Body) {
+					continue
+				}
+				if id, ok := existing[normaliseBody(comment.Body)]; ok {
+					copies[comment.ID] = id
+					continue
+				}
+				existing[normaliseBody(comment.Body)] = 0
+				missing = append(missing, missingComment { comment, duplicate.issue.Number })
+			}
+		}
+		sort.SliceStable(missing, func(i, j int) bool { return missing[i].comment.CreatedAt.Before(missing[j].comment.CreatedAt) })
+		for _, m := range missing {
+			if verbosity > 1 || dryRun {
+				fmt.Printf("Copying comment %d from #%d to #%d\n", m.comment.ID, m.from, keep.issue.Number)
+			}
+			if !dryRun {
+				copies[m.comment.ID] = postIssueComment(client, owner, repo, keep.issue.Number, m.comment.Body).ID
+			}
+		}
+
+		for _, duplicate := range candidates[1:] {
+			numDuplicates++
+			fmt.Printf("Closing #%d as a duplicate of #%d\n", duplicate.issue.Number, keep.issue.Number)
+			if !dryRun {
+				postIssueComment(client, owner, repo, duplicate.issue.Number, fmt.Sprintf(duplicateNotice, keep.issue.Number))
+				if duplicate.issue.State != "closed" {
+					closeIssue(owner, repo, credFile, duplicate.issue.Number)
+				}
+				runLog.Info(logContext { bug: key, issue: duplicate.issue.Number }, "Closed as a duplicate of #%d", keep.issue.Number)
+			}
+		}
+		if !dryRun {
+			repointState(state, key, keep.issue, copies)
+		}
+	}
+	fmt.Printf("Found %d duplicate issues.\n", numDuplicates)
+}
+
+// Points the migration state of a bug at the issue which was kept, if it
+// refers to one of the duplicates, so that later runs don't update or lock
+// an issue which has been closed.
+// state: The migration state.
+// bugId: ID of the legacy bug.
+// keep: The issue which was kept.
+// copies: IDs of the comments on the kept issue, by the IDs of the same
+// comments on the duplicates.
+func repointState(state *migrationState, bugId int64, keep octokit.Issue, copies map[int]int) {
+	record, ok := state.Bugs[bugId]
+	if !ok || record.Issue == keep.Number {
+		return
+	}
+	record.Issue = keep.Number
+	record.IssueState = keep.State
+	// The kept issue hasn't necessarily been locked.
+	record.Locked = false
+	for i := range record.Comments {
+		if id, ok := copies[record.Comments[i].GithubId]; ok {
+			record.Comments[i].GithubId = id
+		}
+	}
+	saveState(state)
+	runLog.Info(logContext { bug: bugId, issue: keep.Number }, "Updated the migration state to refer to the kept issue")
+}
+
+// Checks whether an issue has already been closed as a duplicate.
+// issue: The issue and its comments.
+func isClosedDuplicate(issue issueWithComments) bool {
+	if issue.issue.State != "closed" {
+		return false
+	}
+	for _, comment := range issue.comments {
+		if duplicateNoticePattern.MatchString(comment.Body) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts the comments which were migrated from the legacy bug tracker, as
+// opposed to duplicate notices, history, or replies made on GitHub.
+// comments: The comments on an issue.
+func countMigratedComments(comments []octokit.IssueComment) (n int) {
+	for _, comment := range comments {
+		if strings.HasPrefix(comment.Body, "Author: ") && strings.Contains(comment.Body, "\nDate: ") {
+			n++
+		}
+	}
+	return
+}
+
+// Posts a comment on an issue.
+// client: GitHub API client.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// number: Number of the issue.
+// body: Body of the comment.
+func postIssueComment(client *octokit.Client, owner, repo string, number int, body string) *octokit.IssueComment {
+	input := octokit.M{"body": body}
+	comment, result := client.IssueComments().Create(nil, octokit.M{"owner": owner, "repo": repo, "number": number}, input)
+	if result.HasError() {
+		fmt.Printf("Encountered an error when attempting to comment on issue #%d\n", number)
+		log.Fatal(result)
+	}
+	return comment
+}
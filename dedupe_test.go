@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDedupeIssues(t *testing.T) {
+	fake := startFakeGithub(t)
+	state := testState(t)
+	start := time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+	comment := func(text string) string {
+		return fmt.Sprintf("Author: hol353\nDate: 2012-01-02\n\n%s", text)
+	}
+	body := "Legacy Bug ID: 5\nAuthor: hol353\n"
+
+	// The most complete issue, which should be kept.
+	keep := fake.AddIssue("Wheat", body, "open")
+	for i, text := range []string { "A", "B", "C" } {
+		fake.AddComment(keep, comment(text), start.Add(time.Duration(i) * time.Minute))
+	}
+	// Two duplicates, whose missing comments should be copied in the order
+	// in which they were posted.
+	duplicate := fake.AddIssue("Wheat", body, "open")
+	fake.AddComment(duplicate, comment("A"), start)
+	d := fake.AddComment(duplicate, comment("D"), start.Add(5 * time.Minute))
+	other := fake.AddIssue("Wheat", body, "closed")
+	fake.AddComment(other, comment("E"), start.Add(4 * time.Minute))
+	// Issues which mention the bug, but weren't migrated from it.
+	fake.AddIssue("Barley", "Legacy Bug ID: 6\nSee Legacy Bug ID: 5", "open")
+	fake.AddIssue("Oats", "Same as Bug #5", "open")
+
+	// The state refers to one of the duplicates.
+	state.Bugs[5] = &bugState { Issue: duplicate, IssueState: "open", Locked: true, Comments: []commentState { { Id: 51, GithubId: d } } }
+
+	dedupeIssues("owner", "repo", "", state, false, 0)
+
+	expected := []string { comment("A"), comment("B"), comment("C"), comment("E"), comment("D") }
+	if actual := fake.CommentBodies(keep); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected the kept issue's comments to be %q, but got %q", expected, actual)
+	}
+	for _, number := range []int { duplicate, other } {
+		issue := fake.Issue(number)
+		comments := fake.CommentBodies(number)
+		if issue.State != "closed" || comments[len(comments) - 1] != fmt.Sprintf(duplicateNotice, keep) {
+			t.Errorf("Expected #%d to be closed as a duplicate of #%d, but it's %s with comments %q", number, keep, issue.State, comments)
+		}
+	}
+	for number := other + 1; number <= fake.NumIssues(); number++ {
+		if issue := fake.Issue(number); issue.State != "open" || len(fake.CommentBodies(number)) != 0 {
+			t.Errorf("Expected #%d to be left alone", number)
+		}
+	}
+
+	// The state now refers to the kept issue, and to the copy of comment D.
+	saved, err := loadState(state.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := saved.Bugs[5]
+	if record.Issue != keep || record.IssueState != "open" || record.Locked {
+		t.Errorf("Expected the state to refer to #%d, but got %+v", keep, record)
+	}
+	if id := record.Comments[0].GithubId; id == d || id == 0 {
+		t.Errorf("Expected comment 51 to refer to its copy, but it refers to %d", id)
+	}
+
+	// Running it again doesn't change anything.
+	posts, patches := fake.requests["POST"], fake.requests["PATCH"]
+	dedupeIssues("owner", "repo", "", state, false, 0)
+	if fake.requests["POST"] != posts || fake.requests["PATCH"] != patches {
+		t.Errorf("Expected a second run not to change anything, but it made %d more POSTs and %d more PATCHes", fake.requests["POST"] - posts, fake.requests["PATCH"] - patches)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A minimal in-process FTP server which stores files in a local directory.
+// It implements just enough of the protocol for uploadFileFtp (login,
+// passive mode, CWD, PWD, MKD and STOR), so that attachment uploads can be
+// tested without the real web server.
+type fakeFtp struct {
+	listener	net.Listener
+	// Directory in which uploaded files are stored.
+	root		string
+	user		string
+	pass		string
+	// If true, creating directories and storing files fails.
+	readOnly	bool
+}
+
+// A connection to the fake FTP server.
+type fakeFtpSession struct {
+	server		*fakeFtp
+	conn		net.Conn
+	reader		*bufio.Reader
+	// Current directory, relative to the root. Always starts with a slash.
+	dir			string
+	loggedIn	bool
+	user		string
+	// Listener for the next data connection, opened by PASV/EPSV.
+	data		net.Listener
+}
+
+// Starts a fake FTP server on a local port.
+// root: Directory in which uploaded files are stored.
+// user: Username which the server accepts.
+// pass: Password which the server accepts.
+func newFakeFtp(root, user, pass string) (*fakeFtp, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &fakeFtp { listener: listener, root: root, user: user, pass: pass }
+	go f.accept()
+	return f, nil
+}
+
+// Gets the host and port on which the server is listening.
+func (f *fakeFtp) Addr() (host, port string) {
+	host, port, _ = net.SplitHostPort(f.listener.Addr().String())
+	return
+}
+
+// Stops the server.
+func (f *fakeFtp) Close() error {
+	return f.listener.Close()
+}
+
+// Accepts control connections until the server is closed.
+func (f *fakeFtp) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		session := &fakeFtpSession { server: f, conn: conn, reader: bufio.NewReader(conn), dir: "/" }
+		go session.serve()
+	}
+}
+
+// Sends a reply on the control connection.
+func (s *fakeFtpSession) reply(code int, message string) {
+	fmt.Fprintf(s.conn, "%d %s\r\n", code, message)
+}
+
+// Gets the local path of a (possibly relative) path on the server. Paths
+// can't escape the server's root directory.
+func (s *fakeFtpSession) localPath(name string) string {
+	if !strings.HasPrefix(name, "/") {
+		name = path.Join(s.dir, name)
+	}
+	return filepath.Join(s.server.root, filepath.FromSlash(path.Clean("/" + name)))
+}
+
+// Handles commands until the client quits.
+func (s *fakeFtpSession) serve() {
+	defer s.conn.Close()
+	defer s.closeData()
+	s.reply(220, "Fake FTP server ready")
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			command, arg = line[:i], line[i + 1:]
+		}
+		command = strings.ToUpper(command)
+
+		if !s.loggedIn && command != "USER" && command != "PASS" && command != "QUIT" && command != "FEAT" {
+			s.reply(530, "Not logged in")
+			continue
+		}
+		switch command {
+		case "USER":
+			s.user = arg
+			s.reply(331, "Password required")
+		case "PASS":
+			if s.user == s.server.user && arg == s.server.pass {
+				s.loggedIn = true
+				s.reply(230, "Logged in")
+			} else {
+				s.reply(530, "Login incorrect")
+			}
+		case "FEAT":
+			fmt.Fprint(s.conn, "211-Features:\r\n EPSV\r\n PASV\r\n211 End\r\n")
+		case "TYPE", "NOOP":
+			s.reply(200, "OK")
+		case "OPTS":
+			s.reply(501, "Option not supported")
+		case "PWD":
+			s.reply(257, fmt.Sprintf("\"%s\" is the current directory", s.dir))
+		case "CWD":
+			dir := arg
+			if !strings.HasPrefix(dir, "/") {
+				dir = path.Join(s.dir, dir)
+			}
+			if info, err := os.Stat(s.localPath(dir)); err != nil || !info.IsDir() {
+				s.reply(550, "No such directory")
+			} else {
+				s.dir = path.Clean("/" + dir)
+				s.reply(250, "Directory changed")
+			}
+		case "MKD":
+			if s.server.readOnly {
+				s.reply(550, "Permission denied")
+			} else if _, err := os.Stat(s.localPath(arg)); err == nil {
+				s.reply(550, "Directory already exists")
+			} else if err := os.Mkdir(s.localPath(arg), 0755); err != nil {
+				s.reply(550, "Unable to create directory")
+			} else {
+				s.reply(257, fmt.Sprintf("\"%s\" created", arg))
+			}
+		case "EPSV", "PASV":
+			s.openData(command)
+		case "STOR":
+			s.store(arg)
+		case "QUIT":
+			s.reply(221, "Goodbye")
+			return
+		default:
+			s.reply(502, "Command not implemented")
+		}
+	}
+}
+
+// Opens a listener for a passive mode data connection.
+// command: EPSV or PASV.
+func (s *fakeFtpSession) openData(command string) {
+	s.closeData()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.reply(425, "Unable to open data connection")
+		return
+	}
+	s.data = listener
+	port := listener.Addr().(*net.TCPAddr).Port
+	if command == "EPSV" {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	} else {
+		s.reply(227, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port / 256, port % 256))
+	}
+}
+
+// Closes the data connection listener, if there is one.
+func (s *fakeFtpSession) closeData() {
+	if s.data != nil {
+		s.data.Close()
+		s.data = nil
+	}
+}
+
+// Receives a file over the data connection. Existing files are overwritten.
+// name: Path of the file on the server.
+func (s *fakeFtpSession) store(name string) {
+	if s.data == nil {
+		s.reply(425, "Use PASV or EPSV first")
+		return
+	}
+	defer s.closeData()
+	if s.server.readOnly {
+		s.reply(550, "Permission denied")
+		return
+	}
+	file, err := os.Create(s.localPath(name))
+	if err != nil {
+		s.reply(550, "Unable to create file")
+		return
+	}
+	defer file.Close()
+
+	s.reply(150, "Ok to send data")
+	conn, err := s.data.Accept()
+	if err != nil {
+		s.reply(425, "Unable to open data connection")
+		return
+	}
+	_, err = io.Copy(file, conn)
+	conn.Close()
+	if err != nil {
+		s.reply(426, "Transfer aborted")
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process fake of the parts of the GitHub REST API used by this
+// program, so that commands can be tested end-to-end without touching a real
+// repository. It keeps issues and comments in memory, paginates lists with
+// Link headers, and can simulate primary rate limits and abuse detection.
+type fakeGithub struct {
+	server		*httptest.Server
+	mutex		sync.Mutex
+	issues		[]*fakeIssue
+	comments	[]*fakeComment
+	nextComment	int
+	// Number of requests allowed per rate limit window. 0 for unlimited.
+	rateLimit	int
+	// Length of a rate limit window.
+	window		time.Duration
+	remaining	int
+	reset		time.Time
+	// Every abuseEvery'th content-creating request fails with an abuse
+	// detection error. 0 to disable.
+	abuseEvery	int
+	numCreations	int
+	// Number of requests received, by method.
+	requests	map[string]int
+}
+
+type fakeLabel struct {
+	Name		string		`json:"name"`
+}
+
+type fakeUser struct {
+	Login		string		`json:"login"`
+}
+
+type fakeIssue struct {
+	Number		int			`json:"number"`
+	Url			string		`json:"url"`
+	HtmlUrl		string		`json:"html_url"`
+	Title		string		`json:"title"`
+	Body		string		`json:"body"`
+	State		string		`json:"state"`
+	Locked		bool		`json:"locked"`
+	LockReason	string		`json:"active_lock_reason,omitempty"`
+	Labels		[]fakeLabel	`json:"labels"`
+	Comments	int			`json:"comments"`
+	User		fakeUser	`json:"user"`
+	CreatedAt	time.Time	`json:"created_at"`
+	UpdatedAt	time.Time	`json:"updated_at"`
+	ClosedAt	*time.Time	`json:"closed_at"`
+}
+
+type fakeComment struct {
+	Id			int			`json:"id"`
+	Url			string		`json:"url"`
+	HtmlUrl		string		`json:"html_url"`
+	Body		string		`json:"body"`
+	User		fakeUser	`json:"user"`
+	CreatedAt	time.Time	`json:"created_at"`
+	UpdatedAt	time.Time	`json:"updated_at"`
+	// Number of the issue to which the comment belongs.
+	issue		int
+}
+
+// The fields of an issue which can be set when creating or updating it.
+type fakeIssueParams struct {
+	Title		*string		`json:"title"`
+	Body		*string		`json:"body"`
+	State		*string		`json:"state"`
+	Labels		[]string	`json:"labels"`
+}
+
+// Number of items per page, if the request doesn't say.
+const fakeGithubPageSize = 30
+
+var (
+	fakeIssuesPath = regexp.MustCompile(`^/repos/[^/]+/[^/]+/issues$`)
+	fakeIssuePath = regexp.MustCompile(`^/repos/[^/]+/[^/]+/issues/(\d+)$`)
+	fakeLockPath = regexp.MustCompile(`^/repos/[^/]+/[^/]+/issues/(\d+)/lock$`)
+	fakeCommentsPath = regexp.MustCompile(`^/repos/[^/]+/[^/]+/issues/(\d+)/comments$`)
+	fakeCommentPath = regexp.MustCompile(`^/repos/[^/]+/[^/]+/issues/comments/(\d+)$`)
+)
+
+// Starts a fake GitHub API server.
+// rateLimit: Number of requests allowed per rate limit window. 0 for unlimited.
+// window: Length of a rate limit window.
+// abuseEvery: Every abuseEvery'th content-creating request fails with an abuse detection error. 0 to disable.
+func newFakeGithub(rateLimit int, window time.Duration, abuseEvery int) *fakeGithub {
+	f := &fakeGithub {
+		nextComment: 1,
+		rateLimit: rateLimit,
+		window: window,
+		remaining: rateLimit,
+		reset: time.Now().Add(window).Truncate(time.Second),
+		abuseEvery: abuseEvery,
+		requests: make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Starts a fake GitHub without rate limits, and points the program at it
+// until the test finishes.
+func startFakeGithub(t *testing.T) *fakeGithub {
+	f := newFakeGithub(0, time.Minute, 0)
+	apiUrl, tokens, interval := githubApiUrl, githubLimiter.tokens, githubLimiter.creationInterval
+	githubApiUrl = f.Url()
+	githubLimiter.tokens = newTokenPool(staticToken("fake-token"))
+	githubLimiter.creationInterval = 0
+	t.Cleanup(func() {
+		f.Close()
+		githubApiUrl, githubLimiter.tokens, githubLimiter.creationInterval = apiUrl, tokens, interval
+	})
+	return f
+}
+
+// Adds an issue, as if it had been posted by an earlier run.
+// Returns the number of the issue.
+// title: Title of the issue.
+// body: Body of the issue.
+// state: State of the issue (open or closed).
+// comments: Bodies of the comments on the issue.
+func (f *fakeGithub) AddIssue(title, body, state string, comments ...string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now().UTC()
+	issue := &fakeIssue { Number: len(f.issues) + 1, Title: title, Body: body, State: state, Labels: []fakeLabel{}, CreatedAt: now, UpdatedAt: now }
+	f.issues = append(f.issues, issue)
+	for _, body := range comments {
+		f.comments = append(f.comments, &fakeComment { Id: f.nextComment, Body: body, CreatedAt: now, UpdatedAt: now, issue: issue.Number })
+		f.nextComment++
+		issue.Comments++
+	}
+	return issue.Number
+}
+
+// Adds a comment to an issue, as if it had been posted at a given time.
+// Returns the ID of the comment.
+// number: Number of the issue.
+// body: Body of the comment.
+// createdAt: Time at which the comment was posted.
+func (f *fakeGithub) AddComment(number int, body string, createdAt time.Time) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	comment := &fakeComment { Id: f.nextComment, Body: body, CreatedAt: createdAt, UpdatedAt: createdAt, issue: number }
+	f.comments = append(f.comments, comment)
+	f.nextComment++
+	f.findIssue(strconv.Itoa(number)).Comments++
+	return comment.Id
+}
+
+// Gets an issue by number, or nil if there is no such issue.
+// number: Number of the issue.
+func (f *fakeGithub) Issue(number int) *fakeIssue {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.findIssue(strconv.Itoa(number))
+}
+
+// Gets the number of issues.
+func (f *fakeGithub) NumIssues() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.issues)
+}
+
+// Gets the bodies of the comments on an issue, oldest first.
+// number: Number of the issue.
+func (f *fakeGithub) CommentBodies(number int) (bodies []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, comment := range f.comments {
+		if comment.issue == number {
+			bodies = append(bodies, comment.Body)
+		}
+	}
+	return
+}
+
+// Gets the base URL of the API, with a trailing slash.
+func (f *fakeGithub) Url() string {
+	return f.server.URL + "/"
+}
+
+// Stops the server.
+func (f *fakeGithub) Close() {
+	f.server.Close()
+}
+
+// Handles an API request.
+func (f *fakeGithub) serve(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests[r.Method]++
+
+	if r.Header.Get("Authorization") == "" {
+		f.error(w, http.StatusUnauthorized, "Requires authentication")
+		return
+	}
+	if f.rateLimit > 0 {
+		if time.Now().After(f.reset) {
+			f.remaining = f.rateLimit
+			// X-RateLimit-Reset is in whole seconds, so reset on a whole second.
+			f.reset = time.Now().Add(f.window).Truncate(time.Second)
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(f.rateLimit))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(f.reset.Unix(), 10))
+		if f.remaining <= 0 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			f.error(w, http.StatusForbidden, "API rate limit exceeded")
+			return
+		}
+		f.remaining--
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(f.remaining))
+	}
+	if isContentCreation(r) && f.abuseEvery > 0 {
+		f.numCreations++
+		if f.numCreations % f.abuseEvery == 0 {
+			w.Header().Set("Retry-After", "1")
+			f.error(w, http.StatusForbidden, "You have triggered an abuse detection mechanism. Please wait a few minutes before you try again.")
+			return
+		}
+	}
+
+	path := r.URL.Path
+	if fakeIssuesPath.MatchString(path) && r.Method == "GET" {
+		f.listIssues(w, r)
+	} else if fakeIssuesPath.MatchString(path) && r.Method == "POST" {
+		f.createIssue(w, r)
+	} else if m := fakeIssuePath.FindStringSubmatch(path); m != nil && (r.Method == "GET" || r.Method == "PATCH") {
+		f.updateIssue(w, r, m[1])
+	} else if m := fakeLockPath.FindStringSubmatch(path); m != nil && r.Method == "PUT" {
+		f.lockIssue(w, r, m[1])
+	} else if m := fakeCommentsPath.FindStringSubmatch(path); m != nil && r.Method == "GET" {
+		f.listComments(w, r, m[1])
+	} else if m := fakeCommentsPath.FindStringSubmatch(path); m != nil && r.Method == "POST" {
+		f.createComment(w, r, m[1])
+	} else if m := fakeCommentPath.FindStringSubmatch(path); m != nil && r.Method == "PATCH" {
+		f.updateComment(w, r, m[1])
+	} else {
+		f.error(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// Writes an error response.
+func (f *fakeGithub) error(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string { "message": message })
+}
+
+// Writes a JSON response.
+func (f *fakeGithub) json(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Works out which items of a list belong on the requested page, and sets
+// the Link header to point at the next and last pages.
+// Returns the start and end indices of the page.
+func (f *fakeGithub) paginate(w http.ResponseWriter, r *http.Request, n int) (int, int) {
+	perPage := fakeGithubPageSize
+	if p, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && p > 0 {
+		perPage = p
+	}
+	page := 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	numPages := (n + perPage - 1) / perPage
+	if page < numPages {
+		link := func(p int) string {
+			query := r.URL.Query()
+			query.Set("page", strconv.Itoa(p))
+			return fmt.Sprintf("<%s%s?%s>", f.server.URL, r.URL.Path, query.Encode())
+		}
+		w.Header().Set("Link", fmt.Sprintf("%s; rel=\"next\", %s; rel=\"last\"", link(page + 1), link(numPages)))
+	}
+	start := min((page - 1) * perPage, n)
+	return start, min(start + perPage, n)
+}
+
+// Reads the JSON body of a request.
+func (f *fakeGithub) readBody(r *http.Request, value interface{}) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// Finds an issue by number, or returns nil.
+func (f *fakeGithub) findIssue(number string) *fakeIssue {
+	n, _ := strconv.Atoi(number)
+	if n < 1 || n > len(f.issues) {
+		return nil
+	}
+	return f.issues[n - 1]
+}
+
+func (f *fakeGithub) listIssues(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = "open"
+	}
+	// Newest first, like GitHub.
+	var issues []*fakeIssue
+	for i := len(f.issues) - 1; i >= 0; i-- {
+		if state == "all" || f.issues[i].State == state {
+			issues = append(issues, f.issues[i])
+		}
+	}
+	start, end := f.paginate(w, r, len(issues))
+	f.json(w, http.StatusOK, append([]*fakeIssue{}, issues[start:end]...))
+}
+
+func (f *fakeGithub) createIssue(w http.ResponseWriter, r *http.Request) {
+	var params fakeIssueParams
+	if err := f.readBody(r, &params); err != nil || params.Title == nil || *params.Title == "" {
+		f.error(w, http.StatusUnprocessableEntity, "Validation Failed")
+		return
+	}
+	now := time.Now().UTC()
+	number := len(f.issues) + 1
+	issue := &fakeIssue {
+		Number: number,
+		Url: fmt.Sprintf("%s%s/%d", f.server.URL, r.URL.Path, number),
+		HtmlUrl: fmt.Sprintf("https://github.com%s/%d", strings.TrimPrefix(r.URL.Path, "/repos"), number),
+		Title: *params.Title,
+		State: "open",
+		Labels: []fakeLabel{},
+		User: fakeUser { "fake-user" },
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	f.issues = append(f.issues, issue)
+	f.applyIssueParams(issue, params)
+	f.json(w, http.StatusCreated, issue)
+}
+
+func (f *fakeGithub) updateIssue(w http.ResponseWriter, r *http.Request, number string) {
+	issue := f.findIssue(number)
+	if issue == nil {
+		f.error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if r.Method == "PATCH" {
+		var params fakeIssueParams
+		if err := f.readBody(r, &params); err != nil {
+			f.error(w, http.StatusBadRequest, "Problems parsing JSON")
+			return
+		}
+		if params.State != nil && *params.State != "open" && *params.State != "closed" {
+			f.error(w, http.StatusUnprocessableEntity, "Validation Failed")
+			return
+		}
+		f.applyIssueParams(issue, params)
+		issue.UpdatedAt = time.Now().UTC()
+	}
+	f.json(w, http.StatusOK, issue)
+}
+
+// Applies the fields set in a create or update request to an issue.
+func (f *fakeGithub) applyIssueParams(issue *fakeIssue, params fakeIssueParams) {
+	if params.Title != nil {
+		issue.Title = *params.Title
+	}
+	if params.Body != nil {
+		issue.Body = *params.Body
+	}
+	if params.State != nil && *params.State != issue.State {
+		issue.State = *params.State
+		issue.ClosedAt = nil
+		if issue.State == "closed" {
+			now := time.Now().UTC()
+			issue.ClosedAt = &now
+		}
+	}
+	if params.Labels != nil {
+		issue.Labels = []fakeLabel{}
+		for _, label := range params.Labels {
+			issue.Labels = append(issue.Labels, fakeLabel { label })
+		}
+	}
+}
+
+func (f *fakeGithub) lockIssue(w http.ResponseWriter, r *http.Request, number string) {
+	issue := f.findIssue(number)
+	if issue == nil {
+		f.error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	var params struct {
+		LockReason	string	`json:"lock_reason"`
+	}
+	f.readBody(r, &params)
+	if params.LockReason != "" && !isLockReason(params.LockReason) {
+		f.error(w, http.StatusUnprocessableEntity, "Validation Failed")
+		return
+	}
+	issue.Locked = true
+	issue.LockReason = params.LockReason
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGithub) listComments(w http.ResponseWriter, r *http.Request, number string) {
+	issue := f.findIssue(number)
+	if issue == nil {
+		f.error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	comments := []*fakeComment{}
+	for _, comment := range f.comments {
+		if comment.issue == issue.Number {
+			comments = append(comments, comment)
+		}
+	}
+	start, end := f.paginate(w, r, len(comments))
+	f.json(w, http.StatusOK, comments[start:end])
+}
+
+func (f *fakeGithub) createComment(w http.ResponseWriter, r *http.Request, number string) {
+	issue := f.findIssue(number)
+	if issue == nil {
+		f.error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	var params struct {
+		Body	string	`json:"body"`
+	}
+	if err := f.readBody(r, &params); err != nil || params.Body == "" {
+		f.error(w, http.StatusUnprocessableEntity, "Validation Failed")
+		return
+	}
+	now := time.Now().UTC()
+	comment := &fakeComment {
+		Id: f.nextComment,
+		Url: fmt.Sprintf("%s%s/%d", f.server.URL, strings.Replace(r.URL.Path, "/" + number + "/comments", "/comments", 1), f.nextComment),
+		HtmlUrl: fmt.Sprintf("%s#issuecomment-%d", issue.HtmlUrl, f.nextComment),
+		Body: params.Body,
+		User: fakeUser { "fake-user" },
+		CreatedAt: now,
+		UpdatedAt: now,
+		issue: issue.Number,
+	}
+	f.nextComment++
+	f.comments = append(f.comments, comment)
+	issue.Comments++
+	f.json(w, http.StatusCreated, comment)
+}
+
+func (f *fakeGithub) updateComment(w http.ResponseWriter, r *http.Request, id string) {
+	n, _ := strconv.Atoi(id)
+	for _, comment := range f.comments {
+		if comment.Id != n {
+			continue
+		}
+		var params struct {
+			Body	string	`json:"body"`
+		}
+		if err := f.readBody(r, &params); err != nil || params.Body == "" {
+			f.error(w, http.StatusUnprocessableEntity, "Validation Failed")
+			return
+		}
+		comment.Body = params.Body
+		comment.UpdatedAt = time.Now().UTC()
+		f.json(w, http.StatusOK, comment)
+		return
+	}
+	f.error(w, http.StatusNotFound, "Not Found")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An in-process fake of the BugTracker.NET website, which serves fixture
+// pages with the same structure as the real site, including its oddities.
+// It's used to check that the scraper still understands the site.
+type fakeTracker struct {
+	server		*httptest.Server
+}
+
+// The bug list. Bugs are listed newest first, and the last row is a footer.
+// Bug 2001 is beyond the range of bugs which are migrated.
+const fakeBugList = `<html><body><table class="bugt">
+<tr><th>id</th><th>priority</th><th>status</th><th>desc</th><th>project</th><th>category</th><th>reported by</th><th>reported on</th><th>assigned to</th></tr>
+<tr><td>2001</td><td>3_Low</td><td>1_New</td><td>Out of range</td><td>APSIM</td><td>Bug</td><td>hol353:</td><td>1/2/2019 3:04:05 PM</td><td></td></tr>
+<tr><td>2</td><td>1_High</td><td>Closed</td><td>Crash when loading a simulation</td><td>APSIM</td><td>Bug</td><td>ver078:</td><td>3/14/2012 9:05:00 AM</td><td>hol353</td></tr>
+<tr><td>1</td><td>2_Medium</td><td>4_Review</td><td>Wheat yield is too low</td><td>APSIM</td><td>Science</td><td>hol353:</td><td>1/2/2012 10:30:00 PM</td><td>ver078</td></tr>
+<tr><td colspan="9">2 bugs</td></tr>
+</table></body></html>`
+
+// The pages of each bug. Posts are listed newest first. The metadata of
+// comment 12 is full of non-breaking spaces, comment 686 is spam,
+// comment 13 only has a short date, and file 23 has no link.
+var fakeBugPages = map[int]string {
+	1: `<html><body>
+<div class="chg"><span class="pst">changed 14 by ver078 2012-1-4 8:00 AM, permalink edit delete</span><table><tr><td>changed status from "1_New" to "4_Review"
+changed assigned_to from "" to "ver078"</td></tr></table></div>
+<div class="cmt"><span class="pst">comment 13 posted by ver078 2012-1-4, permalink edit delete</span><table><tr><td>Confirmed.</td></tr></table></div>
+<div class="cmt"><span class="pst">comment 686 posted by spammer 2012-1-3 1:00 AM, permalink edit delete</span><table><tr><td>Cheap watches</td></tr></table></div>
+<div class="cmt"><span class="pst">comment&nbsp;12&nbsp;posted&nbsp;by&nbsp;hol353&nbsp;2012-1-3&nbsp;11:15&nbsp;AM,&nbsp;permalink&nbsp;edit&nbsp;delete</span><table><tr><td>Still happening in 7.4.</td></tr></table></div>
+<div class="cmt"><span class="pst">comment 11 posted by hol353 2012-1-2 10:30 PM, permalink edit delete</span><table><tr><td>Wheat yields are about half of what they should be.</td></tr></table></div>
+</body></html>`,
+	2: `<html><body>
+<div class="cmt"><span class="pst">file 23 posted by hol353 2012-3-15 2:50 PM, permalink edit delete</span><table><tr><td>Notes</td></tr></table>
+<div><span><img src="attach.gif"></span><span>notes.doc</span><span>(missing)</span></div>
+<span class="pst">size:&nbsp;1024&nbsp;bytes</span></div>
+<div class="cmt"><span class="pst">file 22 posted by hol353 2012-3-15 2:45 PM, permalink edit delete</span><table><tr><td>Logs</td></tr></table>
+<div><span><img src="attach.gif"></span><span>error log.txt</span><a href="view_attachment.aspx?id=22&amp;bug_id=2">[view]</a></div>
+<span class="pst">size:&nbsp;300&nbsp;bytes</span></div>
+<div class="cmt"><span class="pst">file 21 posted by ver078 2012-3-14 9:10 AM, permalink edit delete</span><table><tr><td>Screenshot</td></tr></table>
+<div><span><img src="attach.gif"></span><span>crash.png</span><a href="view_attachment.aspx?id=21&amp;bug_id=2">[view]</a></div>
+<span class="pst">size:&nbsp;2048&nbsp;bytes</span></div>
+<div class="cmt"><span class="pst">comment 20 posted by ver078 2012-3-14 9:05 AM, permalink edit delete</span><table><tr><td>APSIM crashes when I open the attached simulation.</td></tr></table></div>
+</body></html>`,
+}
+
+// Related bugs and subscribers of each bug.
+var fakeRelationships = map[int]string {
+	2: `<tr><td>1</td><td>Wheat yield is too low</td><td>caused by</td><td>parent</td></tr>`,
+}
+var fakeSubscribers = map[int]string {
+	1: `<tr><td>hol353</td><td>hol353@example.com</td></tr><tr><td>ver078</td><td>ver078@example.com</td></tr>`,
+}
+
+// Starts a fake bug tracker.
+func newFakeTracker() *fakeTracker {
+	f := &fakeTracker{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Gets the root URL of the bug tracker, with a trailing slash.
+func (f *fakeTracker) Url() string {
+	return f.server.URL + "/"
+}
+
+// Stops the server.
+func (f *fakeTracker) Close() {
+	f.server.Close()
+}
+
+// Handles a request for a page.
+func (f *fakeTracker) serve(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	switch r.URL.Path {
+	case "/bugs.aspx":
+		http.SetCookie(w, &http.Cookie { Name: "bugs_query", Value: r.URL.Query().Get("qu_id") })
+		fmt.Fprint(w, "<html><body></body></html>")
+	case "/print_bugs.aspx":
+		// Like the real site, the bug list only works after visiting bugs.aspx.
+		if _, err := r.Cookie("bugs_query"); err != nil {
+			http.Error(w, "No query selected", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, fakeBugList)
+	case "/edit_bug.aspx":
+		page, ok := fakeBugPages[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	case "/relationships.aspx":
+		id, _ = strconv.Atoi(r.URL.Query().Get("bgid"))
+		fmt.Fprintf(w, `<html><body><table class="bugt"><tr><th>id</th><th>desc</th><th>comment</th><th>parent or child</th></tr>%s</table></body></html>`, fakeRelationships[id])
+	case "/view_subscribers.aspx":
+		fmt.Fprintf(w, `<html><body><table class="bugt"><tr><th>user</th><th>email</th></tr>%s</table></body></html>`, fakeSubscribers[id])
+	case "/view_attachment.aspx":
+		sizes := map[int]int { 21: 2048, 22: 300 }
+		size, ok := sizes[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write([]byte(strings.Repeat("x", size)))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Gets the bugs which the scraper should find on the fake bug tracker.
+func (f *fakeTracker) ExpectedBugs() []Bug {
+	root := f.Url()
+	date := func(year, month, day, hour, minute int) time.Time {
+		return time.Date(year, time.Month(month), day, hour, minute, 0, 0, legacyLocation)
+	}
+	bugs := []Bug {
+		{
+			id: 1,
+			description: "Wheat yield is too low",
+			priority: "2_Medium",
+			status: "4_Review",
+			project: "APSIM",
+			category: "Science",
+			author: "hol353",
+			date: date(2012, 1, 2, 22, 30),
+			dateText: "1/2/2012 10:30:00 PM",
+			assignee: "ver078",
+			comments: []Comment {
+				{ id: 11, author: "hol353", date: date(2012, 1, 2, 22, 30), dateText: "2012-1-2 10:30 PM", text: "Wheat yields are about half of what they should be." },
+				{ id: 12, author: "hol353", date: date(2012, 1, 3, 11, 15), dateText: "2012-1-3 11:15 AM", text: "Still happening in 7.4." },
+				{ id: 686, author: "spammer", date: date(2012, 1, 3, 1, 0), dateText: "2012-1-3 1:00 AM", text: "Cheap watches" },
+				{ id: 13, author: "ver078", date: date(2012, 1, 4, 0, 0), dateText: "2012-1-4", text: "Confirmed." },
+			},
+			history: []HistoryEvent {
+				{ author: "ver078", date: date(2012, 1, 4, 8, 0), field: "status", from: "1_New", to: "4_Review", text: `changed status from "1_New" to "4_Review"` },
+				{ author: "ver078", date: date(2012, 1, 4, 8, 0), field: "assigned_to", from: "", to: "ver078", text: `changed assigned_to from "" to "ver078"` },
+			},
+			subscribers: []string { "hol353", "ver078" },
+			url: root + "edit_bug.aspx?id=1",
+		},
+		{
+			id: 2,
+			description: "Crash when loading a simulation",
+			priority: "1_High",
+			status: "Closed",
+			project: "APSIM",
+			category: "Bug",
+			author: "ver078",
+			date: date(2012, 3, 14, 9, 5),
+			dateText: "3/14/2012 9:05:00 AM",
+			assignee: "hol353",
+			comments: []Comment {
+				{ id: 20, author: "ver078", date: date(2012, 3, 14, 9, 5), dateText: "2012-3-14 9:05 AM", text: "APSIM crashes when I open the attached simulation." },
+				{ id: 21, author: "ver078", date: date(2012, 3, 14, 9, 10), dateText: "2012-3-14 9:10 AM", text: "Screenshot", attachments: []Attachment {
+					{ name: "crash.png", size: 2048, url: root + "view_attachment.aspx?id=21&bug_id=2" },
+				} },
+				{ id: 22, author: "hol353", date: date(2012, 3, 15, 14, 45), dateText: "2012-3-15 2:45 PM", text: "Logs", attachments: []Attachment {
+					{ name: "error log.txt", size: 300, url: root + "view_attachment.aspx?id=22&bug_id=2" },
+				} },
+				// The file has no link, so it's dropped.
+				{ id: 23, author: "hol353", date: date(2012, 3, 15, 14, 50), dateText: "2012-3-15 2:50 PM", text: "Notes" },
+			},
+			related: []Relationship {
+				{ id: 1, comment: "caused by", direction: "parent" },
+			},
+			url: root + "edit_bug.aspx?id=2",
+		},
+	}
+	for i := range bugs {
+		for j := range bugs[i].comments {
+			bugs[i].comments[j].assignFileNames()
+		}
+	}
+	return bugs
+}
+
+func TestScraper(t *testing.T) {
+	tracker := newFakeTracker()
+	defer tracker.Close()
+	scrapeRelations = true
+	defer func() { scrapeRelations = false }()
+	actual := getBugs(0, -1, tracker.Url())
+	expected := tracker.ExpectedBugs()
+	if len(actual) != len(expected) {
+		t.Errorf("Expected %d bugs but found %d", len(expected), len(actual))
+	}
+	for i := 0; i < len(actual) && i < len(expected); i++ {
+		if !reflect.DeepEqual(actual[i], expected[i]) {
+			t.Errorf("Bug #%d differs.\nExpected: %+v\nActual:   %+v", expected[i].id, expected[i], actual[i])
+		}
+	}
+
+	// The file without a link should be reported.
+	found := false
+	for _, warning := range summaryReport.warnings {
+		found = found || (warning.context.comment == 23 && strings.Contains(warning.message, "notes.doc"))
+	}
+	if !found {
+		t.Errorf("Expected a warning about notes.doc, but got %+v", summaryReport.warnings)
+	}
+
+	// The spam comment should be removed by the default filter rules.
+	defaults, err := newFilter(defaultFilterRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, excluded := defaults.Apply(actual)
+	if len(excluded) != 1 || excluded[0].CommentId != 686 {
+		t.Errorf("Expected the default filter rules to exclude comment 686, but they excluded %+v", excluded)
+	}
+}
+
+func TestScraperWithoutRelations(t *testing.T) {
+	tracker := newFakeTracker()
+	defer tracker.Close()
+	for _, bug := range getBugs(0, -1, tracker.Url()) {
+		if bug.related != nil || bug.subscribers != nil {
+			t.Errorf("Expected relations of bug #%d not to be scraped, but got %+v and %+v", bug.id, bug.related, bug.subscribers)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A rule which excludes comments or bugs from the migration. Every condition
+// given in the rule must match, and a rule must give at least one condition.
+type filterRule struct {
+	// Why matching content is excluded, e.g. "spam". Shown in the report.
+	Reason		string		`json:"reason"`
+	// What the rule excludes: "comment" (the default) or "bug".
+	Exclude		string		`json:"exclude,omitempty"`
+	// IDs of the comments or bugs.
+	Ids			[]int64		`json:"ids,omitempty"`
+	// Username of the author. Case insensitive.
+	Author		string		`json:"author,omitempty"`
+	// Regular expression which matches the text. For bugs, this is matched
+	// against the title and the description.
+	Text		string		`json:"text,omitempty"`
+	// Only match content posted before/after this date (yyyy-mm-dd), in the
+	// bug tracker's time zone.
+	Before		string		`json:"before,omitempty"`
+	After		string		`json:"after,omitempty"`
+	re			*regexp.Regexp
+	before		time.Time
+	after		time.Time
+}
+
+const (
+	excludeComment = "comment"
+	excludeBug = "bug"
+)
+
+// Comments which were excluded before the filter rules existed. These are
+// spam, and are always excluded, as well as anything matched by the rules in
+// a filter rules file.
+var defaultFilterRules = []filterRule {
+	{ Reason: "spam", Ids: []int64{ 686, 688, 32121, 32124, 32125, 32284, 32287, 32295, 32311, 32331, 32355, 32380, 32394, 32396, 32397, 32420, 32479, 32544, 32605, 32683, 32717, 32774, 32775, 32848, 32767, 32938, 32939, 32984, 33012, 33438, 33552, 33888, 33926, 33950, 33951, 34103, 34108, 34109, 34113, 34116, 34128, 34131, 34132, 33525, 33542, 33666, 33945, 33955, 34122, 34134 } },
+}
+
+// Something which was excluded by a filter rule.
+type filteredItem struct {
+	LegacyId	int64		`json:"legacyId"`
+	// ID of the comment, or 0 if the whole bug was excluded.
+	CommentId	int64		`json:"commentId,omitempty"`
+	Author		string		`json:"author"`
+	Date		time.Time	`json:"date"`
+	Reason		string		`json:"reason"`
+}
+
+// Excludes comments and bugs which match any of a set of rules.
+type filter struct {
+	rules			[]filterRule
+	// If true, excluded content is kept in the archive.
+	keepExcluded	bool
+	// File to which the excluded content is reported. May be empty.
+	report			string
+}
+
+// The filter applied to bugs before they are used. Set up by main, since the
+// rules depend on the command line.
+var contentFilter *filter
+
+// Reads filter rules from a JSON file, e.g.
+// [
+//     { "reason": "spam", "ids": [ 686, 688 ] },
+//     { "reason": "spam", "author": "spammer" },
+//     { "reason": "test bugs", "exclude": "bug", "text": "(?i)^test", "before": "2010-01-01" }
+// ]
+// file: Path to the rules file.
+func loadFilterRules(file string) ([]filterRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []filterRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Unable to read filter rules file %s: %v", file, err)
+	}
+	return rules, nil
+}
+
+// Creates a filter, checking that all of its rules are valid. Dates in the
+// rules are parsed in legacyLocation, so it must already have been set from
+// --source-tz.
+// rules: The rules. Content which matches any rule is excluded.
+func newFilter(rules []filterRule) (*filter, error) {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Exclude == "" {
+			rule.Exclude = excludeComment
+		}
+		if rule.Exclude != excludeComment && rule.Exclude != excludeBug {
+			return nil, fmt.Errorf("Filter rule %d: unknown exclude %s (expected %s or %s)", i + 1, rule.Exclude, excludeComment, excludeBug)
+		}
+		if len(rule.Ids) == 0 && rule.Author == "" && rule.Text == "" && rule.Before == "" && rule.After == "" {
+			return nil, fmt.Errorf("Filter rule %d has no conditions, and would exclude everything", i + 1)
+		}
+		if rule.Reason == "" {
+			rule.Reason = "filter rule " + fmt.Sprint(i + 1)
+		}
+		var err error
+		if rule.Text != "" {
+			if rule.re, err = regexp.Compile(rule.Text); err != nil {
+				return nil, fmt.Errorf("Filter rule %d: invalid text pattern %s: %v", i + 1, rule.Text, err)
+			}
+		}
+		if rule.Before != "" {
+			if rule.before, err = time.ParseInLocation("2006-01-02", rule.Before, legacyLocation); err != nil {
+				return nil, fmt.Errorf("Filter rule %d: invalid date %s: %v", i + 1, rule.Before, err)
+			}
+		}
+		if rule.After != "" {
+			if rule.after, err = time.ParseInLocation("2006-01-02", rule.After, legacyLocation); err != nil {
+				return nil, fmt.Errorf("Filter rule %d: invalid date %s: %v", i + 1, rule.After, err)
+			}
+		}
+	}
+	return &filter { rules: rules }, nil
+}
+
+// Checks whether a rule matches some content.
+// id: ID of the bug or comment.
+// author: Username of the author.
+// date: Date on which the content was posted.
+// text: Text of the content.
+func (r *filterRule) matches(id int64, author string, date time.Time, text string) bool {
+	if len(r.Ids) > 0 {
+		found := false
+		for _, ruleId := range r.Ids {
+			if ruleId == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Author != "" && !strings.EqualFold(r.Author, author) {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(text) {
+		return false
+	}
+	if r.Before != "" && !date.Before(r.before) {
+		return false
+	}
+	if r.After != "" && date.Before(r.after) {
+		return false
+	}
+	return true
+}
+
+// Gets the reason why some content is excluded, or "" if it isn't.
+// exclude: The type of content: excludeComment or excludeBug.
+// id: ID of the bug or comment.
+// author: Username of the author.
+// date: Date on which the content was posted.
+// text: Text of the content.
+func (f *filter) reason(exclude string, id int64, author string, date time.Time, text string) string {
+	for i := range f.rules {
+		if f.rules[i].Exclude == exclude && f.rules[i].matches(id, author, date, text) {
+			return f.rules[i].Reason
+		}
+	}
+	return ""
+}
+
+// Removes the excluded bugs and comments. The bugs passed in aren't modified.
+// Returns the remaining bugs, and what was excluded.
+// bugs: The bugs.
+func (f *filter) Apply(bugs []Bug) (kept []Bug, excluded []filteredItem) {
+	for _, bug := range bugs {
+		text := bug.description
+		if len(bug.comments) > 0 {
+			text += "\n" + bug.comments[0].text
+		}
+		if reason := f.reason(excludeBug, bug.id, bug.author, bug.date, text); reason != "" {
+			excluded = append(excluded, filteredItem { LegacyId: bug.id, Author: bug.author, Date: bug.date, Reason: reason })
+			continue
+		}
+		comments := make([]Comment, 0, len(bug.comments))
+		for _, comment := range bug.comments {
+			if reason := f.reason(excludeComment, comment.id, comment.author, comment.date, comment.text); reason != "" {
+				excluded = append(excluded, filteredItem { LegacyId: bug.id, CommentId: comment.id, Author: comment.author, Date: comment.date, Reason: reason })
+				continue
+			}
+			comments = append(comments, comment)
+		}
+		bug.comments = comments
+		kept = append(kept, bug)
+	}
+	return
+}
+
+// Applies the content filter (if there is one) to some bugs, and reports
+// what was excluded.
+// Returns the remaining bugs.
+// bugs: The bugs.
+// verbosity: level of output detail.
+func filterBugs(bugs []Bug, verbosity int) []Bug {
+	if contentFilter == nil {
+		return bugs
+	}
+	kept, excluded := contentFilter.Apply(bugs)
+	numBugs := 0
+	for _, item := range excluded {
+		if item.CommentId == 0 {
+			numBugs++
+		}
+		runLog.Info(logContext { bug: item.LegacyId, comment: item.CommentId }, "Excluded by filter: %s", item.Reason)
+		summaryReport.Skip(logContext { bug: item.LegacyId, comment: item.CommentId }, "%s (posted by %s)", item.Reason, item.Author)
+		if verbosity > 1 {
+			if item.CommentId == 0 {
+				fmt.Printf("Skipping bug #%d by %s: %s\n", item.LegacyId, item.Author, item.Reason)
+			} else {
+				fmt.Printf("Skipping comment %d on bug #%d by %s: %s\n", item.CommentId, item.LegacyId, item.Author, item.Reason)
+			}
+		}
+	}
+	if verbosity > 0 && len(excluded) > 0 {
+		fmt.Printf("Filtered out %d bugs and %d comments.\n", numBugs, len(excluded) - numBugs)
+	}
+	if contentFilter.report != "" {
+		if err := writeFilterReport(contentFilter.report, excluded); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return kept
+}
+
+// Writes the excluded bugs and comments to a file as JSON.
+// file: Path of the report.
+// excluded: What was excluded.
+func writeFilterReport(file string, excluded []filteredItem) error {
+	if excluded == nil {
+		excluded = []filteredItem{}
+	}
+	data, err := json.MarshalIndent(excluded, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewFilter(t *testing.T) {
+	invalid := []filterRule {
+		{ Reason: "unknown exclude", Exclude: "issue", Author: "spammer" },
+		{ Reason: "no conditions" },
+		{ Reason: "no conditions", Exclude: excludeBug },
+		{ Text: "(unclosed" },
+		{ Before: "14/03/2012" },
+		{ After: "2012-13-01" },
+	}
+	for _, rule := range invalid {
+		if _, err := newFilter([]filterRule { rule }); err == nil {
+			t.Errorf("Expected rule %+v to be rejected", rule)
+		}
+	}
+
+	f, err := newFilter([]filterRule { { Ids: []int64 { 1 } }, { Reason: "spam", Exclude: excludeBug, Author: "spammer" } })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.rules[0].Exclude != excludeComment || f.rules[0].Reason != "filter rule 1" {
+		t.Errorf("Expected a rule without exclude or reason to exclude comments as filter rule 1, but got %+v", f.rules[0])
+	}
+	if f.rules[1].Exclude != excludeBug || f.rules[1].Reason != "spam" {
+		t.Errorf("Expected the second rule to be unchanged, but got %+v", f.rules[1])
+	}
+}
+
+func TestFilterRuleMatches(t *testing.T) {
+	date := time.Date(2012, 3, 14, 9, 5, 0, 0, legacyLocation)
+	tests := []struct {
+		rule		filterRule
+		id			int64
+		author		string
+		date		time.Time
+		text		string
+		matches		bool
+	}{
+		{ filterRule { Ids: []int64 { 686, 688 } }, 688, "spammer", date, "Cheap watches", true },
+		{ filterRule { Ids: []int64 { 686, 688 } }, 687, "spammer", date, "Cheap watches", false },
+		// Authors are case insensitive.
+		{ filterRule { Author: "Spammer" }, 1, "spammer", date, "Hi", true },
+		{ filterRule { Author: "spammer" }, 1, "spammer2", date, "Hi", false },
+		// Text patterns match anywhere unless anchored.
+		{ filterRule { Text: "(?i)cheap" }, 1, "spammer", date, "Buy Cheap watches", true },
+		{ filterRule { Text: "^cheap" }, 1, "spammer", date, "Buy cheap watches", false },
+		// Before excludes the day itself; after includes it.
+		{ filterRule { Before: "2012-03-15" }, 1, "hol353", date, "Hi", true },
+		{ filterRule { Before: "2012-03-14" }, 1, "hol353", date, "Hi", false },
+		{ filterRule { After: "2012-03-14" }, 1, "hol353", date, "Hi", true },
+		{ filterRule { After: "2012-03-15" }, 1, "hol353", date, "Hi", false },
+		// Every condition must match.
+		{ filterRule { Author: "spammer", After: "2012-01-01", Text: "watches" }, 1, "spammer", date, "Cheap watches", true },
+		{ filterRule { Author: "spammer", After: "2012-01-01", Text: "watches" }, 1, "hol353", date, "Cheap watches", false },
+		{ filterRule { Author: "spammer", After: "2013-01-01", Text: "watches" }, 1, "spammer", date, "Cheap watches", false },
+	}
+	for _, test := range tests {
+		f, err := newFilter([]filterRule { test.rule })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := f.rules[0].matches(test.id, test.author, test.date, test.text); matches != test.matches {
+			t.Errorf("Expected rule %+v to match %d by %s (%q) to be %v", test.rule, test.id, test.author, test.text, test.matches)
+		}
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	f, err := newFilter([]filterRule {
+		// Excludes comment 12 on bug 1.
+		{ Reason: "noise", Ids: []int64 { 12 } },
+		// Bug-level rules match bug IDs rather than comment IDs, so this
+		// doesn't match comment 20, and there's no bug 20.
+		{ Reason: "wrong level", Exclude: excludeBug, Ids: []int64 { 20 } },
+		// Bug-level rules match the title and description.
+		{ Reason: "crashes", Exclude: excludeBug, Text: "Crash when" },
+		// Comment-level rules only match comments.
+		{ Reason: "titles", Text: "Wheat yield is too low" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bugs := testBugs()
+	kept, excluded := f.Apply(bugs)
+	if len(kept) != 1 || kept[0].id != 1 || len(kept[0].comments) != 1 || kept[0].comments[0].id != 11 {
+		t.Errorf("Expected to keep bug 1 with comment 11 only, but kept %+v", kept)
+	}
+	expected := []filteredItem {
+		{ LegacyId: 1, CommentId: 12, Author: "ver078", Date: bugs[0].comments[1].date, Reason: "noise" },
+		{ LegacyId: 2, Author: "ver078", Date: bugs[1].date, Reason: "crashes" },
+	}
+	if !reflect.DeepEqual(excluded, expected) {
+		t.Errorf("Expected to exclude %+v, but excluded %+v", expected, excluded)
+	}
+	// The bugs passed in aren't modified.
+	if len(bugs[0].comments) != 2 {
+		t.Errorf("Expected the original bug to keep its comments, but it has %d", len(bugs[0].comments))
+	}
+}
+
+func TestScrapeBugsKeepExcluded(t *testing.T) {
+	tracker := newFakeTracker()
+	defer tracker.Close()
+	defer func(previous *filter) { contentFilter = previous }(contentFilter)
+
+	for _, keepExcluded := range []bool { false, true } {
+		f, err := newFilter([]filterRule { { Reason: "spam", Ids: []int64 { 686 } } })
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.keepExcluded = keepExcluded
+		contentFilter = f
+
+		archive := filepath.Join(t.TempDir(), "bugs.json")
+		bugs := scrapeBugs(archive, 0, -1, tracker.Url())
+		archived, _, err := loadArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Excluded content is never migrated, but is only archived if asked.
+		if hasComment(bugs, 686) {
+			t.Errorf("keepExcluded %v: expected comment 686 to be filtered out of the bugs", keepExcluded)
+		}
+		if hasComment(archived, 686) != keepExcluded {
+			t.Errorf("keepExcluded %v: expected comment 686 in the archive to be %v", keepExcluded, keepExcluded)
+		}
+	}
+}
+
+// Checks whether any of some bugs has a comment.
+// bugs: The bugs.
+// id: ID of the comment.
+func hasComment(bugs []Bug, id int64) bool {
+	for _, bug := range bugs {
+		for _, comment := range bug.comments {
+			if comment.id == id {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/octokit/go-octokit/octokit"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Base URL of the GitHub API.
+var githubApiUrl = "https://api.github.com/"
+
+// Gets the base URL of the GitHub website which serves the API, with a
+// trailing slash: https://api.github.com/ is served by https://github.com/,
+// and GitHub Enterprise serves its API under /api/v3/.
+func githubWebUrl() string {
+	u, err := url.Parse(githubApiUrl)
+	if err != nil {
+		return "https://github.com/"
+	}
+	u.Host = strings.TrimPrefix(u.Host, "api.")
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v3") + "/"
+	return u.String()
+}
+
+// Applies a single rate limiting and retry policy to every request made to
+// the GitHub API:
+// - When the rate limit is nearly exhausted, requests wait until it resets
+//   (as given by the X-RateLimit-Reset header).
+// - Requests rejected by the primary or secondary (abuse detection) rate
+//   limits wait for Retry-After/X-RateLimit-Reset, or back off, and retry.
+// - Requests which fail with a 5xx status or a network error are retried
+//   with exponential backoff and jitter, unless they are POSTs. A POST which
+//   fails this way may still have created the issue or comment, so retrying
+//   it could post a duplicate; the error is returned instead. POSTs rejected
+//   by the rate limits are retried, since GitHub rejects those before doing
+//   anything with them.
+// - Content-creating requests (POST/PATCH/PUT/DELETE) are spaced out to
+//   avoid triggering the secondary rate limits in the first place.
+// Requests are authenticated with tokens from the token pool. When several
+// tokens are available, exhausting one token's rate limit switches to the
+// next rather than waiting.
+type githubTransport struct {
+	transport		http.RoundTripper
+	tokens			*tokenPool
+	// Maximum number of times a request will be retried.
+	maxRetries		int
+	// Minimum time between content-creating requests.
+	creationInterval	time.Duration
+	// Number of remaining requests below which we wait for the rate limit to reset.
+	reserve			int
+
+	mutex			sync.Mutex
+	lastCreation	time.Time
+	// Requests will not be sent before this time.
+	blockedUntil	time.Time
+}
+
+// The transport shared by all GitHub clients, so that rate limiting applies
+// across every request made by the program.
+var githubLimiter = &githubTransport {
+	transport: http.DefaultTransport,
+	maxRetries: 8,
+	creationInterval: 5 * time.Second,
+	reserve: 10,
+}
+
+// Creates a GitHub API client which uses the shared rate limiter.
+// credFile: Path to file on disk containing one or more access tokens for
+// GitHub accounts. Only used if no other authentication has been configured.
+func newGithubClient(credFile string) *octokit.Client {
+	loadTokens(credFile)
+	// The transport adds the Authorization header, so octokit doesn't need to.
+	return octokit.NewClientWith(githubApiUrl, "TransferIssues", nil, &http.Client { Transport: githubLimiter })
+}
+
+// Loads the access tokens into the shared rate limiter, unless other
+// authentication has already been configured.
+// credFile: Path to file on disk containing one or more access tokens for
+// GitHub accounts.
+func loadTokens(credFile string) {
+	githubLimiter.mutex.Lock()
+	defer githubLimiter.mutex.Unlock()
+	if githubLimiter.tokens == nil {
+		githubLimiter.tokens = newTokenPool(splitTokens(getSecret(credFile))...)
+	}
+}
+
+// Gets all comments on an issue, following pagination.
+// client: GitHub API client.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// number: Number of the issue.
+func getIssueComments(client *octokit.Client, owner, repo string, number int) (comments []octokit.IssueComment) {
+	url := octokit.Hyperlink(fmt.Sprintf("repos/%s/%s/issues/%d/comments", owner, repo, number))
+	for {
+		page, result := client.IssueComments().All(&url, nil)
+		if result.HasError() {
+			log.Fatal(result)
+		}
+		comments = append(comments, page...)
+		if result.NextPage == nil {
+			return
+		}
+		url = *result.NextPage
+	}
+}
+
+// Checks if a request can safely be sent again if it isn't known whether the
+// first attempt succeeded.
+func isIdempotent(request *http.Request) bool {
+	return request.Method != "POST"
+}
+
+// Checks if a request creates or modifies content.
+func isContentCreation(request *http.Request) bool {
+	return request.Method == "POST" || request.Method == "PATCH" || request.Method == "PUT" || request.Method == "DELETE"
+}
+
+// Sends a request, applying the rate limiting and retry policy.
+func (t *githubTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// The body needs to be re-sent on each retry, so buffer it.
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		t.wait(isContentCreation(request))
+
+		retry := request.Clone(request.Context())
+		if body != nil {
+			retry.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		source, token, err := t.tokens.Next()
+		if err != nil {
+			return nil, err
+		}
+		retry.Header.Set("Authorization", "token " + token)
+		response, err := t.transport.RoundTrip(retry)
+		if err != nil {
+			if !isIdempotent(request) || attempt >= t.maxRetries {
+				return nil, err
+			}
+			delay := backoff(attempt, time.Second, time.Minute)
+			fmt.Printf("GitHub request failed: %v. Retrying in %v...\n", err, delay.Round(time.Second))
+			runLog.Warn(githubLogContext(request), "GitHub request %s %s failed: %v. Retrying in %v", request.Method, request.URL.Path, err, delay.Round(time.Second))
+			time.Sleep(delay)
+			continue
+		}
+		switched := t.recordRateLimit(response, source)
+
+		delay, reason, err := t.retryDelay(request, response, attempt, switched)
+		if err != nil {
+			return nil, err
+		}
+		if delay <= 0 || attempt >= t.maxRetries {
+			return response, nil
+		}
+		drainBody(response.Body)
+		fmt.Printf("%s. Retrying in %v...\n", reason, delay.Round(time.Second))
+		runLog.Warn(githubLogContext(request), "%s. Retrying %s %s in %v", reason, request.Method, request.URL.Path, delay.Round(time.Second))
+		t.block(delay)
+	}
+}
+
+// Matches the paths of API requests about a single issue, capturing its number.
+var issueRequestPath = regexp.MustCompile(`/repos/[^/]+/[^/]+/issues/(\d+)(/|$)`)
+
+// Gets the context in which to log events about a request. Requests about
+// a single issue (or its comments, or its lock) are logged against the issue.
+// request: The request.
+func githubLogContext(request *http.Request) logContext {
+	if m := issueRequestPath.FindStringSubmatch(request.URL.Path); m != nil {
+		if number, err := strconv.Atoi(m[1]); err == nil {
+			return logContext { issue: number }
+		}
+	}
+	return logContext{}
+}
+
+// Waits until the next request may be sent.
+// creation: true if the request creates or modifies content.
+func (t *githubTransport) wait(creation bool) {
+	t.mutex.Lock()
+	now := time.Now()
+	next := t.blockedUntil
+	if creation {
+		paced := t.lastCreation.Add(t.creationInterval)
+		if paced.After(next) {
+			next = paced
+		}
+		if next.Before(now) {
+			t.lastCreation = now
+		} else {
+			t.lastCreation = next
+		}
+	}
+	t.mutex.Unlock()
+
+	if delay := time.Until(next); delay > 0 {
+		addRateLimitSleep(delay)
+		time.Sleep(delay)
+	}
+}
+
+// Prevents any requests from being sent for a given duration.
+func (t *githubTransport) block(delay time.Duration) {
+	t.mutex.Lock()
+	until := time.Now().Add(delay)
+	if until.After(t.blockedUntil) {
+		t.blockedUntil = until
+	}
+	t.mutex.Unlock()
+}
+
+// If the rate limit is nearly exhausted, switches to another token, or if
+// there are none left, blocks all requests until the rate limit resets.
+// Returns true if the transport switched to another token.
+// response: A response to a request.
+// source: Index of the token source which authenticated the request.
+func (t *githubTransport) recordRateLimit(response *http.Response, source int) bool {
+	remaining, err := strconv.Atoi(response.Header.Get("X-RateLimit-Remaining"))
+	if err != nil || remaining >= t.reserve {
+		return false
+	}
+	reset := rateLimitReset(response)
+	if reset <= 0 {
+		return false
+	}
+	if t.tokens.Exhausted(source, time.Now().Add(reset)) {
+		fmt.Printf("GitHub API rate limit nearly exhausted (%d remaining). Switching to another token...\n", remaining)
+		return true
+	}
+	fmt.Printf("GitHub API rate limit nearly exhausted (%d remaining). Waiting %v for it to reset...\n", remaining, reset.Round(time.Second))
+	t.block(reset)
+	return false
+}
+
+// Determines whether (and how long to wait before) a request should be retried.
+// Returns a delay of 0 if the request should not be retried.
+// request: The request.
+// response: The response to the request.
+// attempt: Number of times the request has already been retried.
+// switched: True if the transport has just switched to another token.
+func (t *githubTransport) retryDelay(request *http.Request, response *http.Response, attempt int, switched bool) (time.Duration, string, error) {
+	if response.StatusCode >= 500 {
+		if !isIdempotent(request) {
+			return 0, "", nil
+		}
+		return backoff(attempt, time.Second, 2 * time.Minute), fmt.Sprintf("GitHub returned %s", response.Status), nil
+	}
+	if response.StatusCode != http.StatusForbidden && response.StatusCode != http.StatusTooManyRequests {
+		return 0, "", nil
+	}
+
+	// Rate limit errors are 403/429s, but so are permission errors, so we need
+	// to look at the body to tell them apart. Put the body back afterwards so
+	// that octokit can still read it.
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	message := strings.ToLower(string(body))
+
+	secondary := strings.Contains(message, "abuse detection") || strings.Contains(message, "secondary rate limit")
+	primary := response.Header.Get("X-RateLimit-Remaining") == "0"
+	if !secondary && !primary && response.StatusCode != http.StatusTooManyRequests {
+		return 0, "", nil
+	}
+	if primary && switched {
+		return time.Millisecond, "GitHub API rate limit exceeded for this token", nil
+	}
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, "GitHub API rate limit exceeded", nil
+	}
+	if primary {
+		if reset := rateLimitReset(response); reset > 0 {
+			return reset, "GitHub API rate limit exceeded", nil
+		}
+	}
+	// Secondary rate limits without a Retry-After header - GitHub recommends
+	// waiting at least a minute.
+	return time.Minute + backoff(attempt, time.Minute, 15 * time.Minute), "Triggered GitHub's secondary rate limit", nil
+}
+
+// Extra time to wait after the rate limit resets, to allow for clock skew
+// between us and GitHub.
+var rateLimitLeeway = 5 * time.Second
+
+// Gets the time until the rate limit resets, from the X-RateLimit-Reset
+// header. Returns 0 if the header is missing.
+func rateLimitReset(response *http.Response) time.Duration {
+	reset, err := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.Unix(reset, 0)) + rateLimitLeeway
+}
+
+// Calculates an exponential backoff delay, with random jitter so that
+// retries don't happen in lockstep.
+// attempt: Number of previous attempts.
+// base: Delay after the first attempt.
+// limit: Maximum delay.
+func backoff(attempt int, base, limit time.Duration) time.Duration {
+	delay := limit
+	if attempt < 30 && base << uint(attempt) < limit {
+		delay = base << uint(attempt)
+	}
+	return delay / 2 + time.Duration(rand.Int63n(int64(delay / 2) + 1))
+}
+
+// Ensures the response body is fully read so the connection can be reused.
+func drainBody(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
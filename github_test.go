@@ -0,0 +1,270 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Creates a transport which authenticates with the given tokens, without
+// any pacing of content-creating requests.
+// tokens: The tokens, in order of preference.
+func newTestTransport(tokens ...string) *githubTransport {
+	var sources []tokenSource
+	for _, token := range tokens {
+		sources = append(sources, staticToken(token))
+	}
+	return &githubTransport {
+		transport: http.DefaultTransport,
+		tokens: newTokenPool(sources...),
+		maxRetries: 3,
+		reserve: 10,
+	}
+}
+
+// Creates a response to a request.
+// status: HTTP status code.
+// headers: Header names and values, in pairs.
+// body: Body of the response.
+func testResponse(status int, body string, headers ...string) *http.Response {
+	response := &http.Response {
+		StatusCode: status,
+		Status: strconv.Itoa(status) + " " + http.StatusText(status),
+		Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader(body)),
+	}
+	for i := 0; i + 1 < len(headers); i += 2 {
+		response.Header.Set(headers[i], headers[i + 1])
+	}
+	return response
+}
+
+func TestRetryDelay(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	get := httptest.NewRequest("GET", "/repos/owner/repo/issues", nil)
+	post := httptest.NewRequest("POST", "/repos/owner/repo/issues", nil)
+	tests := []struct {
+		name		string
+		request		*http.Request
+		response	*http.Response
+		switched	bool
+		min, max	time.Duration
+	} {
+		{ "primary rate limit waits for reset", get, testResponse(403, `{"message":"API rate limit exceeded"}`, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", reset), false, 50 * time.Second, 66 * time.Second },
+		{ "primary rate limit after switching token", get, testResponse(403, `{"message":"API rate limit exceeded"}`, "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", reset), true, time.Millisecond, time.Millisecond },
+		{ "Retry-After", post, testResponse(403, `{"message":"You have triggered an abuse detection mechanism"}`, "Retry-After", "7"), false, 7 * time.Second, 7 * time.Second },
+		{ "Retry-After on 429", get, testResponse(429, "", "Retry-After", "3"), false, 3 * time.Second, 3 * time.Second },
+		{ "secondary rate limit without Retry-After", get, testResponse(403, `{"message":"You have exceeded a secondary rate limit"}`), false, time.Minute + 30 * time.Second, 2 * time.Minute },
+		{ "5xx GET", get, testResponse(502, ""), false, 500 * time.Millisecond, time.Second },
+		{ "5xx POST", post, testResponse(502, ""), false, 0, 0 },
+		{ "permission error", get, testResponse(403, `{"message":"Resource not accessible by integration"}`), false, 0, 0 },
+		{ "not found", get, testResponse(404, `{"message":"Not Found"}`), false, 0, 0 },
+	}
+	transport := newTestTransport("token")
+	for _, test := range tests {
+		delay, _, err := transport.retryDelay(test.request, test.response, 0, test.switched)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if delay < test.min || delay > test.max {
+			t.Errorf("%s: expected a delay between %v and %v, but got %v", test.name, test.min, test.max, delay)
+		}
+	}
+}
+
+func TestRetryDelayKeepsBody(t *testing.T) {
+	body := `{"message":"Resource not accessible by integration"}`
+	response := testResponse(403, body)
+	newTestTransport("token").retryDelay(httptest.NewRequest("GET", "/", nil), response, 0, false)
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil || string(data) != body {
+		t.Errorf("Expected the body to still be readable, but got %q (%v)", data, err)
+	}
+}
+
+func TestRecordRateLimit(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+
+	// Plenty of requests left.
+	transport := newTestTransport("token")
+	if transport.recordRateLimit(testResponse(200, "", "X-RateLimit-Remaining", "100", "X-RateLimit-Reset", reset), 0) {
+		t.Errorf("Expected not to switch tokens with plenty of requests left")
+	}
+	if !transport.blockedUntil.IsZero() {
+		t.Errorf("Expected requests not to be blocked with plenty of requests left")
+	}
+
+	// Nearly exhausted with only one token: wait for the reset.
+	if transport.recordRateLimit(testResponse(200, "", "X-RateLimit-Remaining", "5", "X-RateLimit-Reset", reset), 0) {
+		t.Errorf("Expected not to switch tokens with only one token")
+	}
+	if wait := time.Until(transport.blockedUntil); wait < 50 * time.Second || wait > 66 * time.Second {
+		t.Errorf("Expected requests to be blocked until the rate limit resets, but they are blocked for %v", wait)
+	}
+
+	// Nearly exhausted with another token available: switch to it instead.
+	transport = newTestTransport("first", "second")
+	if !transport.recordRateLimit(testResponse(200, "", "X-RateLimit-Remaining", "5", "X-RateLimit-Reset", reset), 0) {
+		t.Errorf("Expected to switch tokens")
+	}
+	if !transport.blockedUntil.IsZero() {
+		t.Errorf("Expected requests not to be blocked after switching tokens")
+	}
+	if _, token, _ := transport.tokens.Next(); token != "second" {
+		t.Errorf("Expected to switch to the second token, but got %s", token)
+	}
+}
+
+// Starts a server which fails the first few requests with a given status,
+// and records the number of requests it has received.
+// failures: Number of requests to fail.
+// status: Status of the failed requests.
+func startFailingServer(t *testing.T, failures, status int) (*httptest.Server, *int) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if requests <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestTransportRetriesServerErrors(t *testing.T) {
+	server, requests := startFailingServer(t, 1, http.StatusBadGateway)
+	client := &http.Client { Transport: newTestTransport("token") }
+	response, err := client.Get(server.URL + "/repos/owner/repo/issues")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainBody(response.Body)
+	if response.StatusCode != http.StatusOK || *requests != 2 {
+		t.Errorf("Expected a failed GET to be retried and succeed, but got %s after %d requests", response.Status, *requests)
+	}
+
+	server, requests = startFailingServer(t, 1, http.StatusBadGateway)
+	response, err = client.Post(server.URL + "/repos/owner/repo/issues", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainBody(response.Body)
+	if response.StatusCode != http.StatusBadGateway || *requests != 1 {
+		t.Errorf("Expected a failed POST not to be retried, but got %s after %d requests", response.Status, *requests)
+	}
+}
+
+func TestTransportSwitchesTokens(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	var mutex sync.Mutex
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "token ")
+		tokens = append(tokens, token)
+		w.Header().Set("X-RateLimit-Reset", reset)
+		if token == "first" {
+			// The first token has run out.
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message":"API rate limit exceeded"}`))
+			return
+		}
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	transport := newTestTransport("first", "second")
+	client := &http.Client { Transport: transport }
+	for i := 0; i < 2; i++ {
+		response, err := client.Get(server.URL + "/repos/owner/repo/issues")
+		if err != nil {
+			t.Fatal(err)
+		}
+		drainBody(response.Body)
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected request %d to succeed, but got %s", i + 1, response.Status)
+		}
+	}
+	if expected := []string { "first", "second", "second" }; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected requests to be authenticated with %v, but got %v", expected, tokens)
+	}
+	if time.Until(transport.blockedUntil) > time.Second {
+		t.Errorf("Expected the transport to switch tokens rather than wait for the rate limit to reset")
+	}
+}
+
+func TestTransportWaitsForRateLimitReset(t *testing.T) {
+	leeway := rateLimitLeeway
+	rateLimitLeeway = 100 * time.Millisecond
+	defer func() { rateLimitLeeway = leeway }()
+
+	tests := []struct {
+		name		string
+		reserve		int
+		rejected	int
+	} {
+		// Stops before the rate limit runs out, so no requests are rejected.
+		{ "reserve", 1, 0 },
+		// Runs the rate limit out, so one request is rejected and retried.
+		{ "no reserve", 0, 1 },
+	}
+	for _, test := range tests {
+		fake := newFakeGithub(2, 2 * time.Second, 0)
+		transport := newTestTransport("token")
+		transport.reserve = test.reserve
+		client := &http.Client { Transport: transport }
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			response, err := client.Get(fake.Url() + "repos/owner/repo/issues")
+			if err != nil {
+				t.Fatal(err)
+			}
+			drainBody(response.Body)
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("%s: expected request %d to succeed, but got %s", test.name, i + 1, response.Status)
+			}
+		}
+		fake.Close()
+		if fake.requests["GET"] != 3 + test.rejected {
+			t.Errorf("%s: expected %d requests, but the server received %d", test.name, 3 + test.rejected, fake.requests["GET"])
+		}
+		if time.Since(start) < 500 * time.Millisecond {
+			t.Errorf("%s: expected the third request to wait for the rate limit to reset", test.name)
+		}
+	}
+}
+
+func TestGithubLogContext(t *testing.T) {
+	tests := []struct {
+		path		string
+		issue		int
+	}{
+		{ "/repos/owner/repo/issues/12", 12 },
+		{ "/repos/owner/repo/issues/12/comments", 12 },
+		{ "/repos/owner/repo/issues/12/lock", 12 },
+		{ "/api/v3/repos/owner/repo/issues/7", 7 },
+		{ "/repos/owner/repo/issues", 0 },
+		// GitHub comment IDs aren't issue numbers.
+		{ "/repos/owner/repo/issues/comments/345", 0 },
+		{ "/rate_limit", 0 },
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		if context := githubLogContext(request); context != (logContext { issue: test.issue }) {
+			t.Errorf("%s: expected issue %d, but got %+v", test.path, test.issue, context)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Stores attachments by committing them into a git repository. Files are
+// staged as they are uploaded, and committed/pushed in batches. The URLs
+// returned by Upload don't resolve until the files have been pushed, so the
+// store must be flushed before they are used.
+type gitStore struct {
+	remote		string
+	branch		string
+	workDir		string
+	rawUrl		string
+	batchSize	int
+	pending		int
+}
+
+// Creates a git attachment store. The remote repository is cloned into
+// workDir if it hasn't been already.
+// remote: URL or path of the repository (a local bare repository is fine).
+// branch: Branch to which attachments will be committed. Created if it doesn't exist.
+// rawUrl: URL under which the raw files on the branch are served. If empty,
+// this is derived from the remote for repositories hosted on GitHub.
+// workDir: Local directory in which the repository will be cloned.
+// batchSize: Number of files to stage before committing and pushing.
+func newGitStore(remote, branch, rawUrl, workDir string, batchSize int) (*gitStore, error) {
+	if rawUrl == "" {
+		rawUrl = githubRawUrl(remote, branch)
+		if rawUrl == "" {
+			return nil, fmt.Errorf("Unable to determine raw file URL for git remote %s", remote)
+		}
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	store := &gitStore {
+		remote: remote,
+		branch: branch,
+		workDir: workDir,
+		rawUrl: strings.TrimRight(rawUrl, "/"),
+		batchSize: batchSize,
+	}
+	if _, err := os.Stat(path.Join(workDir, ".git")); os.IsNotExist(err) {
+		CreateDirIfNotExist(filepath.Dir(workDir))
+		if _, err = store.git("", "clone", remote, workDir); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check out the branch, creating it if the remote doesn't have it yet (this
+	// also handles a freshly created, empty repository).
+	if _, err := store.git(workDir, "fetch", "origin"); err != nil {
+		return nil, err
+	}
+	if _, err := store.git(workDir, "rev-parse", "--verify", "origin/" + branch); err == nil {
+		_, err = store.git(workDir, "checkout", "-B", branch, "origin/" + branch)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err = store.git(workDir, "checkout", "-B", branch); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Returns the raw.githubusercontent.com URL for a branch of a repository
+// hosted on GitHub, or an empty string if the remote is not on GitHub.
+// remote: URL of the repository.
+// branch: Name of the branch.
+func githubRawUrl(remote, branch string) string {
+	re := regexp.MustCompile(`github\.com[:/]([^/]+)/([^/]+?)(\.git)?/?$`)
+	matches := re.FindStringSubmatch(remote)
+	if len(matches) < 3 {
+		return ""
+	}
+	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s", matches[1], matches[2], branch)
+}
+
+// Runs a git command and returns its combined output.
+// dir: Working directory of the command. Empty for the current directory.
+// args: Arguments to pass to git.
+func (g *gitStore) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return string(output), nil
+}
+
+// Copies a file into the repository and stages it. The file is committed
+// and pushed once enough files have been staged.
+// remoteDir: Directory, relative to the root of the repository, in which the file will be stored.
+// localFile: Path to the local file to be stored.
+// Returns the URL of the raw file, which doesn't resolve until the store is flushed.
+func (g *gitStore) Upload(remoteDir, localFile string) (string, error) {
+	remotePath := path.Join(remoteDir, filepath.Base(localFile))
+	if err := copyFile(localFile, filepath.Join(g.workDir, filepath.FromSlash(remotePath))); err != nil {
+		return "", err
+	}
+	if _, err := g.git(g.workDir, "add", "--", remotePath); err != nil {
+		return "", err
+	}
+	g.pending++
+	if g.pending >= g.batchSize {
+		if err := g.Flush(); err != nil {
+			return "", err
+		}
+	}
+	return g.Url(remotePath), nil
+}
+
+// Gets the URL of a raw file on the branch.
+// remotePath: Path of the file, relative to the root of the repository.
+func (g *gitStore) Url(remotePath string) string {
+	return g.rawUrl + "/" + remotePath
+}
+
+// Commits any staged files and pushes them to the remote.
+func (g *gitStore) Flush() error {
+	if g.pending == 0 {
+		return nil
+	}
+
+	// Staging a file identical to one already committed leaves nothing to commit.
+	if _, err := g.git(g.workDir, "diff", "--cached", "--quiet"); err != nil {
+		message := fmt.Sprintf("Add %d migrated attachments", g.pending)
+		if _, err = g.git(g.workDir, g.commitArgs("commit", "-m", message)...); err != nil {
+			return err
+		}
+	}
+	if _, err := g.git(g.workDir, "push", "origin", g.branch); err != nil {
+		return err
+	}
+	g.pending = 0
+	return nil
+}
+
+// Prepends a fallback committer identity to a git command if the user
+// hasn't configured one.
+func (g *gitStore) commitArgs(args ...string) []string {
+	if _, err := g.git(g.workDir, "config", "user.email"); err == nil {
+		return args
+	}
+	return append([]string { "-c", "user.name=TransferIssues", "-c", "user.email=transferissues@localhost" }, args...)
+}
+
+// Copies a file, creating the destination directory if necessary.
+// src: Path of the file to copy.
+// dst: Path to which the file will be copied.
+func copyFile(src, dst string) error {
+	CreateDirIfNotExist(filepath.Dir(dst))
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	// Close flushes the file, so a full disk may only be reported here.
+	return out.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Gets the contents of a file on a branch of a bare repository, or "" if it
+// doesn't exist.
+func gitShow(repo, branch, file string) string {
+	output, err := exec.Command("git", "--git-dir", repo, "show", branch + ":" + file).Output()
+	if err != nil {
+		return ""
+	}
+	return string(output)
+}
+
+func TestGitStore(t *testing.T) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "attachments.git")
+	if output, err := exec.Command("git", "init", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("Unable to create repository: %v\n%s", err, output)
+	}
+	workDir := filepath.Join(dir, "work")
+	store, err := newGitStore(remote, "attachments", "https://example.com/raw/", workDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := writeTestFile(t, "crash.png", "png")
+	url, err := store.Upload("BugAttachments/sha256/ab", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://example.com/raw/BugAttachments/sha256/ab/crash.png"; url != expected {
+		t.Errorf("Expected URL %s, but got %s", expected, url)
+	}
+	// The batch isn't full, so nothing has been pushed yet.
+	if contents := gitShow(remote, "attachments", "BugAttachments/sha256/ab/crash.png"); contents != "" {
+		t.Errorf("Expected crash.png not to be pushed until the batch is full")
+	}
+
+	second := writeTestFile(t, "log.txt", "log")
+	if _, err = store.Upload("BugAttachments/sha256/cd", second); err != nil {
+		t.Fatal(err)
+	}
+	for file, expected := range map[string]string { "BugAttachments/sha256/ab/crash.png": "png", "BugAttachments/sha256/cd/log.txt": "log" } {
+		if contents := gitShow(remote, "attachments", file); contents != expected {
+			t.Errorf("Expected %s to contain %q, but it contained %q", file, expected, contents)
+		}
+	}
+
+	// Uploading a file which is already committed leaves nothing to commit.
+	if _, err = store.Upload("BugAttachments/sha256/ab", first); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run reuses the clone, and picks up where the first left off.
+	store, err = newGitStore(remote, "attachments", "https://example.com/raw", workDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := writeTestFile(t, "notes.doc", "doc")
+	if _, err = store.Upload("BugAttachments/sha256/ef", third); err != nil {
+		t.Fatal(err)
+	}
+	if contents := gitShow(remote, "attachments", "BugAttachments/sha256/ef/notes.doc"); contents != "doc" {
+		t.Errorf("Expected notes.doc to be pushed, but found %q", contents)
+	}
+	output, err := exec.Command("git", "--git-dir", remote, "rev-list", "--count", "attachments").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.TrimSpace(string(output)); count != "2" {
+		t.Errorf("Expected 2 commits, but found %s", count)
+	}
+}
+
+func TestGithubRawUrl(t *testing.T) {
+	tests := map[string]string {
+		"https://github.com/APSIMInitiative/BugAttachments.git": "https://raw.githubusercontent.com/APSIMInitiative/BugAttachments/main",
+		"git@github.com:APSIMInitiative/BugAttachments": "https://raw.githubusercontent.com/APSIMInitiative/BugAttachments/main",
+		"/srv/git/attachments.git": "",
+	}
+	for remote, expected := range tests {
+		if actual := githubRawUrl(remote, "main"); actual != expected {
+			t.Errorf("Expected raw URL of %s to be %q, but got %q", remote, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How a bug's history is migrated.
+const (
+	// The history isn't migrated.
+	historyNone = "none"
+	// The history is posted as a single timeline comment.
+	historyTimeline = "timeline"
+	// Each change is added to the issue as a label, e.g. "status: closed".
+	historyLabels = "labels"
+)
+
+// The first line of a timeline comment.
+const historyHeader = "History imported from the legacy bug tracker:"
+
+// GitHub doesn't allow labels longer than this.
+const maxLabelLength = 50
+
+// A change made to a bug on the bug tracker, such as a change of status,
+// assignee or priority.
+type HistoryEvent struct {
+	author		string
+	date		time.Time
+	// Name of the field which was changed (e.g. status). Empty if the
+	// change couldn't be parsed, in which case text describes it.
+	field		string
+	from		string
+	to			string
+	text		string
+}
+
+// Describes the change.
+func (e *HistoryEvent) ToString() string {
+	if e.field == "" {
+		return e.text
+	}
+	return fmt.Sprintf("%s: %s → %s", e.field, e.from, e.to)
+}
+
+// Gets the label which records the change, or "" if it has no label.
+func (e *HistoryEvent) Label() string {
+	if e.field == "" || e.to == "" {
+		return ""
+	}
+	// Truncate by character, so a multi-byte character is never split.
+	label := []rune(strings.ToLower(e.field) + ": " + e.to)
+	if len(label) > maxLabelLength {
+		label = label[:maxLabelLength]
+	}
+	return string(label)
+}
+
+// Gets the history entries for a particular bug ID.
+// BugTracker shows each edit to a bug as a .chg post, which contains one
+// line per changed field, e.g.
+// changed status from "new" to "in progress"
+// threadDoc: The bug's page.
+// bugId: ID of the bug.
+func getHistory(threadDoc *goquery.Document, bugId int) (history []HistoryEvent) {
+	re := regexp.MustCompile(`^changed (.+?) from "(.*)" to "(.*)"$`)
+	threadDoc.Find(".chg").Each(func(i int, post *goquery.Selection) {
+		header, err := parsePostHeader(post.Find("span.pst").First().Text(), legacyLocation)
+		if err != nil {
+			// History is nice to have, so don't abort the migration.
+			fmt.Printf("Unable to parse history entry on bug #%d: %v\n", bugId, err)
+			return
+		}
+
+		var events []HistoryEvent
+		for _, line := range strings.Split(stripNonBreakingSpaces(post.Find("table:nth-child(2)").Text()), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			event := HistoryEvent { author: header.author, date: header.date, text: line }
+			if matches := re.FindStringSubmatch(line); matches != nil {
+				event.field = matches[1]
+				event.from = matches[2]
+				event.to = matches[3]
+			}
+			events = append(events, event)
+		}
+		// Posts are listed newest first.
+		history = append(events, history...)
+	})
+	return
+}
+
+// Renders a bug's history as a compact timeline, or "" if there is no history.
+func (b *Bug) HistoryString() string {
+	if len(b.history) == 0 {
+		return ""
+	}
+	var str strings.Builder
+	str.WriteString(historyHeader + "\n\n")
+	str.WriteString("| Date | Author | Change |\n")
+	str.WriteString("|---|---|---|\n")
+	for _, event := range b.history {
+		change := strings.Replace(escapeMarkdown(event.ToString()), "|", "\\|", -1)
+		str.WriteString(fmt.Sprintf("| %s | %s | %s |\n", event.date.Format("2006-01-02 15:04 -07:00"), escapeMarkdown(event.author), change))
+	}
+	return str.String()
+}
+
+// Gets the labels which record a bug's history. Only the final value of
+// each field is labelled, as a bug which went from "new" to "closed" would
+// otherwise be labelled with both.
+func (b *Bug) HistoryLabels() (labels []string) {
+	index := make(map[string]int)
+	for _, event := range b.history {
+		label := event.Label()
+		if label == "" {
+			continue
+		}
+		field := strings.ToLower(event.field)
+		if i, ok := index[field]; ok {
+			labels[i] = label
+		} else {
+			index[field] = len(labels)
+			labels = append(labels, label)
+		}
+	}
+	return
+}
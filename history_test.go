@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestHistoryLabels(t *testing.T) {
+	bug := Bug { history: []HistoryEvent {
+		{ field: "status", from: "new", to: "in progress" },
+		{ field: "assigned to", from: "", to: "drew" },
+		{ text: "attached a file" },
+		{ field: "Status", from: "in progress", to: "closed" },
+	} }
+	expected := []string { "status: closed", "assigned to: drew" }
+	if actual := bug.HistoryLabels(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected labels %q, but got %q", expected, actual)
+	}
+}
+
+func TestHistoryLabelTruncation(t *testing.T) {
+	// Each "é" is two bytes, so truncating by byte would split one.
+	event := HistoryEvent { field: "category", to: "Modèle de croissance des céréales et écophysiologie" }
+	label := event.Label()
+	if !utf8.ValidString(label) {
+		t.Errorf("Label %q is not valid UTF-8", label)
+	}
+	if n := utf8.RuneCountInString(label); n != maxLabelLength {
+		t.Errorf("Expected label to be %d characters long, but it was %d", maxLabelLength, n)
+	}
+}
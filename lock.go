@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Reasons which GitHub accepts for locking an issue.
+var lockReasons = []string { "off-topic", "too heated", "resolved", "spam" }
+
+// Which migrated issues are locked.
+const (
+	lockNone = ""
+	// Only closed issues are locked.
+	lockClosed = "closed"
+	// All migrated issues are locked.
+	lockAll = "all"
+)
+
+// Checks whether GitHub accepts a lock reason.
+// reason: The lock reason.
+func isLockReason(reason string) bool {
+	for _, r := range lockReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether an issue should be locked.
+// mode: Which issues are locked (lockNone, lockClosed or lockAll).
+// issueState: State of the issue (open or closed).
+func shouldLock(mode, issueState string) bool {
+	return mode == lockAll || (mode == lockClosed && strings.ToLower(issueState) == "closed")
+}
+
+// Locks the migrated issues which should be locked, so that people don't
+// reply to them expecting the legacy authors to see it. The migration state
+// records which issues have been locked, so each issue is only locked once.
+// Bugs without a state record are skipped, so repos which were migrated
+// before the state was recorded need their state rebuilt (by running with
+// --sync) before their issues can be locked.
+// bugs: The legacy bugs. Issues which don't belong to one of these are left alone.
+// state: The migration state.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// mode: Which issues are locked (lockNone, lockClosed or lockAll).
+// reason: The lock reason.
+// verbosity: level of output detail.
+func lockMigratedIssues(bugs []Bug, state *migrationState, owner, repo, credFile, mode, reason string, verbosity int) {
+	numLocked, numUnrecorded := 0, 0
+	for _, bug := range bugs {
+		if _, ok := state.Bugs[bug.id]; !ok {
+			numUnrecorded++
+		} else if lockMigratedIssue(bug.id, state, owner, repo, credFile, mode, reason) {
+			numLocked++
+		}
+	}
+	if mode != lockNone && numUnrecorded > 0 {
+		fmt.Printf("Warning: %d bugs have no migration state, so their issues can't be locked. Run with --sync to rebuild the state of issues migrated by older versions.\n", numUnrecorded)
+		runLog.Warn(logContext{}, "%d bugs have no migration state, so their issues weren't locked", numUnrecorded)
+	}
+	if verbosity > 0 && mode != lockNone {
+		fmt.Printf("Locking issues...Finished! %d issues locked.\n", numLocked)
+	}
+}
+
+// Locks the issue to which a bug was migrated, if it should be locked and
+// hasn't been already.
+// Returns true if the issue was locked.
+// bugId: ID of the legacy bug.
+// state: The migration state.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// mode: Which issues are locked (lockNone, lockClosed or lockAll).
+// reason: The lock reason.
+func lockMigratedIssue(bugId int64, state *migrationState, owner, repo, credFile, mode, reason string) bool {
+	recorded, ok := state.Bugs[bugId]
+	if !ok || recorded.Locked || !shouldLock(mode, recorded.IssueState) {
+		return false
+	}
+	if err := lockIssue(owner, repo, credFile, recorded.Issue, reason); err != nil {
+		log.Fatal(err)
+	}
+	runLog.Info(logContext { bug: bugId, issue: recorded.Issue }, "Locked issue (%s)", reason)
+	recorded.Locked = true
+	saveState(state)
+	return true
+}
+
+// Locks a GitHub issue. go-octokit doesn't support locking, so the request
+// is sent directly, through the shared rate limiter.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// number: Number of the issue.
+// reason: The lock reason. May be empty.
+func lockIssue(owner, repo, credFile string, number int, reason string) error {
+	loadTokens(credFile)
+	body := []byte("{}")
+	if reason != "" {
+		var err error
+		if body, err = json.Marshal(map[string]string { "lock_reason": reason }); err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%srepos/%s/%s/issues/%d/lock", githubApiUrl, owner, repo, number)
+	request, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// Lock reasons require the sailor-v preview.
+	request.Header.Set("Accept", "application/vnd.github.sailor-v-preview+json")
+	request.Header.Set("Content-Type", "application/json")
+	response, err := (&http.Client { Transport: githubLimiter }).Do(request)
+	if err != nil {
+		return err
+	}
+	defer drainBody(response.Body)
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Unable to lock issue #%d: %s", number, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLockMigratedIssues(t *testing.T) {
+	tests := []struct {
+		mode		string
+		// Whether the issues for bugs 1 (open) and 2 (closed) should be locked.
+		locked		[]bool
+	}{
+		{ lockNone, []bool { false, false } },
+		{ lockClosed, []bool { false, true } },
+		{ lockAll, []bool { true, true } },
+	}
+	for _, test := range tests {
+		fake := startFakeGithub(t)
+		state := testState(t)
+		bugs := append(testBugs(), Bug { id: 3, description: "Not recorded", status: "Closed" })
+		var issues []int
+		for _, bug := range bugs {
+			issueState := "open"
+			if bug.IsClosed() {
+				issueState = "closed"
+			}
+			issues = append(issues, fake.AddIssue(bug.description, bug.ToString(), issueState))
+		}
+		// Bug 3 was migrated before the state was recorded.
+		state.RecordIssue(bugs[0], issues[0], "open")
+		state.RecordIssue(bugs[1], issues[1], "closed")
+
+		lockMigratedIssues(bugs, state, "owner", "repo", "", test.mode, "resolved", 0)
+		for i, locked := range test.locked {
+			issue := fake.Issue(issues[i])
+			if issue.Locked != locked || state.Bugs[bugs[i].id].Locked != locked {
+				t.Errorf("Mode %q: expected issue #%d locked to be %v, but it's %v (state %v)", test.mode, issue.Number, locked, issue.Locked, state.Bugs[bugs[i].id].Locked)
+			}
+			if locked && issue.LockReason != "resolved" {
+				t.Errorf("Mode %q: expected issue #%d to be locked as resolved, but got %q", test.mode, issue.Number, issue.LockReason)
+			}
+		}
+		if fake.Issue(issues[2]).Locked {
+			t.Errorf("Mode %q: expected the issue of a bug without a state record not to be locked", test.mode)
+		}
+
+		// Issues which have already been locked aren't locked again.
+		puts := fake.requests["PUT"]
+		lockMigratedIssues(bugs, state, "owner", "repo", "", test.mode, "resolved", 0)
+		if fake.requests["PUT"] != puts {
+			t.Errorf("Mode %q: expected no more issues to be locked, but %d were", test.mode, fake.requests["PUT"] - puts)
+		}
+	}
+}
+
+func TestLockIssueInvalidReason(t *testing.T) {
+	fake := startFakeGithub(t)
+	number := fake.AddIssue("Bug", "Body", "closed")
+	if err := lockIssue("owner", "repo", "", number, "bored"); err == nil {
+		t.Errorf("Expected an error when locking with an invalid reason")
+	}
+	if fake.Issue(number).Locked {
+		t.Errorf("Expected the issue not to be locked")
+	}
+	if isLockReason("bored") || !isLockReason("too heated") {
+		t.Errorf("Expected only GitHub's lock reasons to be accepted")
+	}
+}
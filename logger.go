@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each run writes a log of what it did to its own file, so that a long
+// migration can be audited afterwards. The log is separate from the progress
+// shown on the console. Events are written as JSON, one per line, e.g.
+// {"time":"2019-05-01T10:00:00Z","level":"info","msg":"Posted comment","bug":12,"comment":345,"issue":67}
+
+const (
+	levelDebug = "debug"
+	levelInfo = "info"
+	levelWarn = "warn"
+	levelError = "error"
+)
+
+// Log levels, least severe first.
+var logLevels = []string { levelDebug, levelInfo, levelWarn, levelError }
+
+// An event in the run log. IDs are omitted if they don't apply.
+type logEvent struct {
+	Time		time.Time	`json:"time"`
+	Level		string		`json:"level"`
+	Message		string		`json:"msg"`
+	Bug			int64		`json:"bug,omitempty"`
+	Comment		int64		`json:"comment,omitempty"`
+	Issue		int			`json:"issue,omitempty"`
+}
+
+// What an event is about.
+type logContext struct {
+	// ID of the legacy bug.
+	bug			int64
+	// ID of the legacy comment.
+	comment		int64
+	// Number of the GitHub issue.
+	issue		int
+}
+
+// Writes events to the run's log file. Until a file is opened, events are
+// discarded.
+type runLogger struct {
+	mutex		sync.Mutex
+	file		*os.File
+	encoder		*json.Encoder
+	// Events less severe than this are discarded.
+	minLevel	int
+}
+
+// The log of the current run.
+var runLog = &runLogger{}
+
+// Gets the index of a log level in logLevels, or -1 if it isn't one.
+// level: Name of the level.
+func logLevelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// Opens a new log file for this run, named after the time at which the run
+// started and its process ID. Runs never share (or append to) a log file.
+// Returns the path of the log file.
+// dir: Directory in which log files are kept.
+// level: Events less severe than this level are discarded.
+func (l *runLogger) Open(dir, level string) (string, error) {
+	minLevel := logLevelIndex(level)
+	if minLevel < 0 {
+		return "", fmt.Errorf("Unknown log level %s (expected one of %s)", level, strings.Join(logLevels, ", "))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("run-%s-%d", time.Now().Format("20060102-150405"), os.Getpid())
+	file := filepath.Join(dir, name + ".jsonl")
+	f, err := os.OpenFile(file, os.O_CREATE | os.O_WRONLY | os.O_EXCL, 0644)
+	for n := 2; os.IsExist(err); n++ {
+		file = filepath.Join(dir, fmt.Sprintf("%s-%d.jsonl", name, n))
+		f, err = os.OpenFile(file, os.O_CREATE | os.O_WRONLY | os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return "", err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.file = f
+	l.encoder = json.NewEncoder(f)
+	l.minLevel = minLevel
+	return file, nil
+}
+
+// Closes the log file.
+func (l *runLogger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.encoder = nil
+	return err
+}
+
+// Writes an event to the log. Events are written immediately, so that
+// nothing is lost if the run is aborted.
+// level: Severity of the event.
+// context: What the event is about.
+// format: Format string of the message.
+// args: Arguments of the format string.
+func (l *runLogger) Log(level string, context logContext, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.encoder == nil || logLevelIndex(level) < l.minLevel {
+		return
+	}
+	// Errors writing the log are ignored, since they shouldn't stop the migration.
+	l.encoder.Encode(logEvent {
+		Time: time.Now().UTC(),
+		Level: level,
+		Message: fmt.Sprintf(format, args...),
+		Bug: context.bug,
+		Comment: context.comment,
+		Issue: context.issue,
+	})
+}
+
+// Writes a debug event to the log.
+func (l *runLogger) Debug(context logContext, format string, args ...interface{}) {
+	l.Log(levelDebug, context, format, args...)
+}
+
+// Writes an informational event to the log.
+func (l *runLogger) Info(context logContext, format string, args ...interface{}) {
+	l.Log(levelInfo, context, format, args...)
+}
+
+// Writes a warning event to the log.
+func (l *runLogger) Warn(context logContext, format string, args ...interface{}) {
+	l.Log(levelWarn, context, format, args...)
+}
+
+// Writes an error event to the log.
+func (l *runLogger) Error(context logContext, format string, args ...interface{}) {
+	l.Log(levelError, context, format, args...)
+}
+
+// Logs output of the standard logger as errors, so that the reason for a
+// log.Fatal ends up in the run log. Use with io.MultiWriter.
+func (l *runLogger) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	// The event has its own timestamp, so drop the standard logger's.
+	if len(message) > 20 {
+		if _, err := time.Parse("2006/01/02 15:04:05", message[:19]); err == nil {
+			message = message[20:]
+		}
+	}
+	l.Error(logContext{}, "%s", message)
+	return len(p), nil
+}
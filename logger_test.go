@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRunLoggerOpen(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 2; i++ {
+		logger := &runLogger{}
+		file, err := logger.Open(dir, levelInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Info(logContext { bug: int64(i + 1) }, "Run %d", i + 1)
+		if err = logger.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	// Runs started at the same time must not write to the same file.
+	if files[0] == files[1] {
+		t.Fatalf("Both runs logged to %s", files[0])
+	}
+	for i, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 {
+			t.Errorf("Expected 1 event in %s, but found %d", file, len(lines))
+		} else if !strings.Contains(lines[0], fmt.Sprintf(`"msg":"Run %d","bug":%d`, i + 1, i + 1)) {
+			t.Errorf("Unexpected event in %s: %s", file, lines[0])
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sentence at the top of each post on a bug's page, which gives the
+// post's type, ID, author and date, e.g.
+// comment 1234 posted by hol353 2012-3-14 9:05 AM, permalink edit delete
+type postHeader struct {
+	// Type of post: comment, file, changed, sent or received.
+	kind		string
+	id			int64
+	author		string
+	date		time.Time
+	// The date as it appeared in the header.
+	dateText	string
+	// False if the header only gave the date, and not the time of day.
+	hasTime		bool
+}
+
+// Matches a post header. The author may contain spaces, so it's everything
+// between "by" and the date. Times may be 12-hour (with AM/PM) or 24-hour.
+var postHeaderPattern = regexp.MustCompile(`^(\w+) (\d+) (?:posted )?by (.+?) ((\d{4})-(\d{1,2})-(\d{1,2})(?: (\d{1,2}):(\d{2})(?: ?([AaPp])\.?[Mm]\.?)?)?)(?:,.*)?$`)
+
+// Matches the attachment size line of a file post, e.g. "size: 2048 bytes".
+var attachmentSizePattern = regexp.MustCompile(`(?i)size:? *(\d+)`)
+
+// The types of post which are known to appear on the bug tracker.
+var postKinds = []string { "comment", "file", "changed", "sent", "received" }
+
+// Parses a post header.
+// header: Text of the header.
+// location: Time zone in which the bug tracker displays dates.
+func parsePostHeader(header string, location *time.Location) (postHeader, error) {
+	header = strings.Join(strings.Fields(stripNonBreakingSpaces(header)), " ")
+	matches := postHeaderPattern.FindStringSubmatch(header)
+	if matches == nil {
+		return postHeader{}, fmt.Errorf("Unrecognised post header \"%s\". Expected \"<type> <id> posted by <author> <yyyy-m-d> [<h:mm> [AM|PM]], ...\"", header)
+	}
+	if !contains(postKinds, matches[1]) {
+		return postHeader{}, fmt.Errorf("Unknown type of post \"%s\" in header \"%s\"", matches[1], header)
+	}
+
+	var parts [5]int
+	for i, match := range matches[5:10] {
+		if match != "" {
+			parts[i], _ = strconv.Atoi(match)
+		}
+	}
+	year, month, day, hour, minute := parts[0], parts[1], parts[2], parts[3], parts[4]
+	hasTime := matches[8] != ""
+	if meridiem := strings.ToUpper(matches[10]); meridiem != "" {
+		if hour < 1 || hour > 12 {
+			return postHeader{}, fmt.Errorf("Invalid 12-hour time in post header \"%s\"", header)
+		}
+		hour %= 12
+		if meridiem == "P" {
+			hour += 12
+		}
+	}
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 {
+		return postHeader{}, fmt.Errorf("Invalid date in post header \"%s\"", header)
+	}
+
+	id, _ := strconv.ParseInt(matches[2], 10, 64)
+	return postHeader {
+		kind: matches[1],
+		id: id,
+		author: matches[3],
+		date: time.Date(year, time.Month(month), day, hour, minute, 0, 0, location),
+		dateText: matches[4],
+		hasTime: hasTime,
+	}, nil
+}
+
+// Parses the size of an attachment from the size line of a file post.
+// text: Text of the size line.
+func parseAttachmentSize(text string) (int64, error) {
+	matches := attachmentSizePattern.FindStringSubmatch(stripNonBreakingSpaces(text))
+	if matches == nil {
+		return 0, fmt.Errorf("Unrecognised attachment size \"%s\"", strings.TrimSpace(text))
+	}
+	return strconv.ParseInt(matches[1], 10, 64)
+}
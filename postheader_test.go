@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The headers are in the form used on the bug tracker's pages, as handled by
+// the original parser: "<type> <id> posted by <author> <yyyy-m-d> <h:mm>
+// <AM|PM>, permalink edit delete", often with non-breaking spaces instead of
+// spaces, and with one comment (13) which only gives the date. Authors may
+// have several words, times may be 24-hour or use a.m./p.m., and history
+// posts say "changed <id> by" rather than "posted by".
+func TestParsePostHeader(t *testing.T) {
+	tests := []struct {
+		name		string
+		header		string
+		expected	postHeader
+		// True if the header should be rejected.
+		fail		bool
+	} {
+		{
+			name: "comment",
+			header: "comment 11 posted by hol353 2012-1-2 10:30 PM, permalink edit delete",
+			expected: postHeader { "comment", 11, "hol353", time.Date(2012, 1, 2, 22, 30, 0, 0, time.UTC), "2012-1-2 10:30 PM", true },
+		},
+		{
+			name: "non-breaking spaces",
+			header: "comment\u00a012\u00a0posted\u00a0by\u00a0hol353\u00a02012-1-3\u00a011:15\u00a0AM,\u00a0permalink\u00a0edit\u00a0delete",
+			expected: postHeader { "comment", 12, "hol353", time.Date(2012, 1, 3, 11, 15, 0, 0, time.UTC), "2012-1-3 11:15 AM", true },
+		},
+		{
+			name: "date only",
+			header: "comment 13 posted by ver078 2012-1-4, permalink edit delete",
+			expected: postHeader { "comment", 13, "ver078", time.Date(2012, 1, 4, 0, 0, 0, 0, time.UTC), "2012-1-4", false },
+		},
+		{
+			name: "file",
+			header: "file 21 posted by ver078 2012-3-14 9:10 AM, permalink edit delete",
+			expected: postHeader { "file", 21, "ver078", time.Date(2012, 3, 14, 9, 10, 0, 0, time.UTC), "2012-3-14 9:10 AM", true },
+		},
+		{
+			name: "noon and midnight",
+			header: "comment 686 posted by spammer 2012-1-3 12:05 AM, permalink edit delete",
+			expected: postHeader { "comment", 686, "spammer", time.Date(2012, 1, 3, 0, 5, 0, 0, time.UTC), "2012-1-3 12:05 AM", true },
+		},
+		{
+			name: "surrounding whitespace",
+			header: "\n\t comment 20 posted by ver078 2012-3-14 9:05 AM, permalink edit delete \n",
+			expected: postHeader { "comment", 20, "ver078", time.Date(2012, 3, 14, 9, 5, 0, 0, time.UTC), "2012-3-14 9:05 AM", true },
+		},
+		{
+			name: "author with several words",
+			header: "comment 14 posted by Dean Holzworth 2012-1-5 3:20 PM, permalink edit delete",
+			expected: postHeader { "comment", 14, "Dean Holzworth", time.Date(2012, 1, 5, 15, 20, 0, 0, time.UTC), "2012-1-5 3:20 PM", true },
+		},
+		{
+			name: "24-hour time",
+			header: "comment 15 posted by hol353 2012-1-5 15:20, permalink edit delete",
+			expected: postHeader { "comment", 15, "hol353", time.Date(2012, 1, 5, 15, 20, 0, 0, time.UTC), "2012-1-5 15:20", true },
+		},
+		{
+			name: "a.m.",
+			header: "comment 16 posted by hol353 2012-1-6 9:05 a.m., permalink edit delete",
+			expected: postHeader { "comment", 16, "hol353", time.Date(2012, 1, 6, 9, 5, 0, 0, time.UTC), "2012-1-6 9:05 a.m.", true },
+		},
+		{
+			name: "p.m.",
+			header: "comment 17 posted by hol353 2012-1-6 12:40 p.m., permalink edit delete",
+			expected: postHeader { "comment", 17, "hol353", time.Date(2012, 1, 6, 12, 40, 0, 0, time.UTC), "2012-1-6 12:40 p.m.", true },
+		},
+		{
+			name: "history",
+			header: "changed 40 by ver078 2012-1-4 8:00 AM, permalink",
+			expected: postHeader { "changed", 40, "ver078", time.Date(2012, 1, 4, 8, 0, 0, 0, time.UTC), "2012-1-4 8:00 AM", true },
+		},
+		{
+			name: "history by an author with several words",
+			header: "changed 41 by Val Snow 2012-1-4 17:30",
+			expected: postHeader { "changed", 41, "Val Snow", time.Date(2012, 1, 4, 17, 30, 0, 0, time.UTC), "2012-1-4 17:30", true },
+		},
+		{ name: "missing date", header: "comment 30 posted by hol353, permalink edit delete", fail: true },
+		{ name: "unknown type", header: "reply 31 posted by hol353 2012-1-3 1:00 PM, permalink edit delete", fail: true },
+		{ name: "invalid month", header: "comment 32 posted by hol353 2012-13-1 1:00 PM, permalink edit delete", fail: true },
+		{ name: "invalid hour", header: "comment 33 posted by hol353 2012-1-3 13:00 PM, permalink edit delete", fail: true },
+		{ name: "empty", header: "", fail: true },
+	}
+	for _, test := range tests {
+		actual, err := parsePostHeader(test.header, time.UTC)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected \"%s\" to be rejected, but it was parsed as %+v", test.name, test.header, actual)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %+v, but got %+v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestParsePostHeaderLocation(t *testing.T) {
+	location := time.FixedZone("AEST", 10 * 60 * 60)
+	header, err := parsePostHeader("comment 11 posted by hol353 2012-1-2 10:30 PM, permalink edit delete", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.date.Equal(time.Date(2012, 1, 2, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected the date to be in the bug tracker's time zone, but got %v", header.date)
+	}
+}
+
+func TestParseAttachmentSize(t *testing.T) {
+	size, err := parseAttachmentSize("size:\u00a02048\u00a0bytes")
+	if err != nil || size != 2048 {
+		t.Errorf("Expected a size of 2048, but got %d (%v)", size, err)
+	}
+	if _, err = parseAttachmentSize("(missing)"); err == nil {
+		t.Error("Expected a line without a size to be rejected")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Total time spent waiting for GitHub's rate limits, in nanoseconds. Updated
+// by the GitHub transport.
+var rateLimitSleep int64
+
+// Records time spent waiting for rate limits.
+// delay: How long was spent waiting.
+func addRateLimitSleep(delay time.Duration) {
+	atomic.AddInt64(&rateLimitSleep, int64(delay))
+}
+
+// How often the progress line is redrawn.
+const progressInterval = 200 * time.Millisecond
+
+// Shows the progress of one phase of a migration (scraping, downloading,
+// uploading or posting) on a single console line, with the rate, ETA and
+// time spent waiting for rate limits. Nothing is shown in quiet mode, or if
+// stdout isn't a terminal (e.g. when it's redirected to a file), since the
+// line is redrawn with \r.
+// All methods may be called on a nil *progress, which does nothing, so that
+// phases which aren't being tracked don't need special cases.
+type progress struct {
+	mutex		sync.Mutex
+	name		string
+	// Number of units of work, e.g. bugs or API calls. 0 if unknown.
+	total		int
+	done		int
+	start		time.Time
+	// Value of rateLimitSleep when the phase started.
+	sleepStart	int64
+	lastDraw	time.Time
+	// Length of the last line drawn, so that it can be cleared.
+	lastLength	int
+	enabled		bool
+	// Phases which happen within this one, and are shown on its line.
+	children	[]*progress
+}
+
+// Progress of posting bugs, measured in API calls, and of the attachment
+// downloads and uploads which happen while posting. These happen deep inside
+// postBug, so they're package level. Nil when not tracked.
+var postProgress, downloadProgress, uploadProgress *progress
+
+// Counts the attachments on some bugs.
+// bugs: The bugs.
+func countAttachments(bugs []Bug) (n int) {
+	for _, bug := range bugs {
+		for _, comment := range bug.comments {
+			n += len(comment.attachments)
+		}
+	}
+	return
+}
+
+// Counts the API calls needed to post some bugs: one for each issue and
+// each comment, one for each timeline and one to close each closed bug.
+// bugs: The bugs.
+// history: How bug history is migrated.
+func countPostCalls(bugs []Bug, history string) (n int) {
+	for _, bug := range bugs {
+		n++
+		if len(bug.comments) > 1 {
+			n += len(bug.comments) - 1
+		}
+		if history == historyTimeline && len(bug.history) > 0 {
+			n++
+		}
+		if bug.IsClosed() {
+			n++
+		}
+	}
+	return
+}
+
+// Checks whether stdout is a terminal.
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+// Starts tracking a phase.
+// name: Name of the phase, e.g. "Posting bugs".
+// total: Number of units of work. 0 if unknown.
+// verbosity: level of output detail. Nothing is shown if this is 0.
+func newProgress(name string, total int, verbosity int) *progress {
+	return &progress {
+		name: name,
+		total: total,
+		start: time.Now(),
+		sleepStart: atomic.LoadInt64(&rateLimitSleep),
+		enabled: verbosity > 0 && isTerminal(),
+	}
+}
+
+// Starts tracking a phase which happens within this one. Its progress is
+// shown on this phase's line, rather than its own.
+// name: Name of the phase, e.g. "attachments uploaded".
+// total: Number of units of work. 0 if unknown.
+func (p *progress) Child(name string, total int) *progress {
+	child := newProgress(name, total, 0)
+	if p != nil {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.children = append(p.children, child)
+	}
+	return child
+}
+
+// Records that some work has been done.
+// n: Number of units of work done.
+func (p *progress) Add(n int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done += n
+	p.draw()
+}
+
+// Changes the amount of work to be done, when it's discovered part way
+// through the phase.
+// total: Number of units of work.
+func (p *progress) SetTotal(total int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total = total
+	p.draw()
+}
+
+// Gets the time which has been spent waiting for rate limits during the phase.
+func (p *progress) Sleeping() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&rateLimitSleep) - p.sleepStart)
+}
+
+// Clears the progress line, so that a message can be printed in its place.
+func (p *progress) Clear() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.enabled && p.lastLength > 0 {
+		fmt.Printf("\r%s\r", strings.Repeat(" ", p.lastLength))
+		p.lastLength = 0
+	}
+}
+
+// Finishes the phase, replacing the progress line with a summary.
+// Returns the summary, e.g. "Posting bugs...Finished! 200 in 5m0s (0.7/s)".
+func (p *progress) Finish() string {
+	if p == nil {
+		return ""
+	}
+	p.Clear()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	elapsed := time.Since(p.start)
+	summary := fmt.Sprintf("%s...Finished! %d in %v (%.1f/s)", p.name, p.done, elapsed.Round(time.Second), rate(p.done, elapsed))
+	if sleeping := p.Sleeping(); sleeping > 0 {
+		summary += fmt.Sprintf(", %v waiting for rate limits", sleeping.Round(time.Second))
+	}
+	return summary
+}
+
+// Gets the amount of work done and the amount to be done.
+func (p *progress) counts() (done, total int) {
+	if p == nil {
+		return 0, 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.done, p.total
+}
+
+// Redraws the progress line, if enough time has passed since it was last
+// drawn. Children update their own counts without drawing anything, so the
+// line only changes when this phase makes progress.
+func (p *progress) draw() {
+	if !p.enabled || time.Since(p.lastDraw) < progressInterval {
+		return
+	}
+	p.lastDraw = time.Now()
+	elapsed := time.Since(p.start)
+	line := fmt.Sprintf("%s...%d", p.name, p.done)
+	if p.total > 0 {
+		line += fmt.Sprintf("/%d (%.2f%%)", p.total, float64(p.done) / float64(p.total) * 100.0)
+	}
+	r := rate(p.done, elapsed)
+	line += fmt.Sprintf(", %.1f/s", r)
+	if p.total > 0 && p.done > 0 && p.done < p.total && r > 0 {
+		eta := time.Duration(float64(p.total - p.done) / r * float64(time.Second))
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	for _, child := range p.children {
+		done, total := child.counts()
+		line += fmt.Sprintf(", %d/%d %s", done, total, child.name)
+	}
+	if sleeping := p.Sleeping(); sleeping > 0 {
+		line += fmt.Sprintf(", %v waiting for rate limits", sleeping.Round(time.Second))
+	}
+	// Pad the line to hide the end of a longer previous line.
+	padding := ""
+	if len(line) < p.lastLength {
+		padding = strings.Repeat(" ", p.lastLength - len(line))
+	}
+	fmt.Printf("%s%s\r", line, padding)
+	p.lastLength = len(line)
+}
+
+// Calculates a rate per second.
+// n: Amount of work done.
+// elapsed: Time taken to do the work.
+func rate(n int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / elapsed.Seconds()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Runs a function, and returns what it wrote to stdout. Stdout is a pipe
+// while the function runs, so it isn't a terminal.
+// f: The function.
+func captureStdout(t *testing.T, f func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(reader)
+		output <- string(data)
+	}()
+	f()
+	writer.Close()
+	return <-output
+}
+
+// Creates a progress tracker which is drawn, as if stdout were a terminal,
+// and which started 10 seconds ago and has spent 90 seconds waiting for
+// rate limits.
+// total: Number of units of work. 0 if unknown.
+func newTestProgress(total int) *progress {
+	return &progress {
+		name: "Posting bugs",
+		total: total,
+		start: time.Now().Add(-10 * time.Second),
+		sleepStart: atomic.LoadInt64(&rateLimitSleep) - int64(90 * time.Second),
+		enabled: true,
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	p := newTestProgress(100)
+	child := p.Child("attachments uploaded", 5)
+	output := captureStdout(t, func() {
+		child.Add(3)
+		p.Add(20)
+	})
+	first := "Posting bugs...20/100 (20.00%), 2.0/s, ETA 40s, 3/5 attachments uploaded, 1m30s waiting for rate limits"
+	if output != first + "\r" {
+		t.Errorf("Expected %q, but got %q", first + "\r", output)
+	}
+
+	// Lines aren't redrawn more often than progressInterval.
+	if output := captureStdout(t, func() { p.Add(1) }); output != "" {
+		t.Errorf("Expected the line not to be redrawn straight away, but got %q", output)
+	}
+
+	// Without a total, there's no percentage or ETA. The shorter line is
+	// padded to hide the end of the previous one.
+	p.lastDraw = time.Time{}
+	output = captureStdout(t, func() { p.SetTotal(0) })
+	line := "Posting bugs...21, 2.1/s, 3/5 attachments uploaded, 1m30s waiting for rate limits"
+	if expected := line + strings.Repeat(" ", len(first) - len(line)) + "\r"; output != expected {
+		t.Errorf("Expected %q, but got %q", expected, output)
+	}
+
+	// Finishing clears the line, and gives a summary.
+	var summary string
+	output = captureStdout(t, func() { summary = p.Finish() })
+	if expected := "\r" + strings.Repeat(" ", len(line)) + "\r"; output != expected {
+		t.Errorf("Expected the line to be cleared with %q, but got %q", expected, output)
+	}
+	if expected := "Posting bugs...Finished! 21 in 10s (2.1/s), 1m30s waiting for rate limits"; summary != expected {
+		t.Errorf("Expected summary %q, but got %q", expected, summary)
+	}
+}
+
+func TestProgressSilent(t *testing.T) {
+	var summary string
+	output := captureStdout(t, func() {
+		// Quiet mode.
+		quiet := newProgress("Posting bugs", 10, 0)
+		quiet.Add(5)
+		quiet.SetTotal(20)
+		quiet.Clear()
+		// Stdout isn't a terminal.
+		redirected := newProgress("Posting bugs", 10, 1)
+		redirected.Add(5)
+		redirected.Clear()
+		summary = redirected.Finish()
+	})
+	if output != "" {
+		t.Errorf("Expected no output, but got %q", output)
+	}
+	// The summary is still available, for the caller to print.
+	if summary == "" {
+		t.Errorf("Expected a summary even when the progress line isn't shown")
+	}
+}
+
+func TestNilProgress(t *testing.T) {
+	var p *progress
+	output := captureStdout(t, func() {
+		child := p.Child("attachments uploaded", 5)
+		child.Add(1)
+		p.Add(1)
+		p.SetTotal(10)
+		p.Clear()
+		if summary := p.Finish(); summary != "" {
+			t.Errorf("Expected no summary, but got %q", summary)
+		}
+	})
+	if output != "" {
+		t.Errorf("Expected no output, but got %q", output)
+	}
+	if done, total := p.counts(); done != 0 || total != 0 || p.Sleeping() != 0 {
+		t.Errorf("Expected a nil progress to have no counts, but got %d/%d and %v", done, total, p.Sleeping())
+	}
+}
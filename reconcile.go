@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/octokit/go-octokit/octokit"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Policies for resolving conflicts, where an issue was opened or closed by
+// hand on GitHub since the migration last set its state.
+const (
+	// The legacy bug tracker wins, and the hand-made change is undone.
+	conflictPolicyLegacy = "legacy"
+	// The hand-made change is kept, and reported.
+	conflictPolicyGithub = "github"
+)
+
+// A change in the open/closed state of an issue, made (or which would be
+// made) to bring it into line with its legacy bug.
+type stateChange struct {
+	LegacyId		int64	`json:"legacyId"`
+	Issue			int		`json:"issue"`
+	LegacyStatus	string	`json:"legacyStatus"`
+	From			string	`json:"from"`
+	To				string	`json:"to"`
+	// One of: closed, reopened, conflict-kept, conflict-overridden, not-reopened.
+	Action			string	`json:"action"`
+}
+
+// Closes issues (and optionally reopens them) so that they match the status
+// of their legacy bugs. The migration state is used to detect issues whose
+// state was changed by hand on GitHub, which are resolved according to the
+// conflict policy. Issues which aren't in the migration state may be closed,
+// but are never reopened, since there's no way to tell whether they were
+// closed by hand.
+// bugs: The legacy bugs.
+// state: The migration state.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// policy: How to resolve conflicts (conflictPolicyLegacy or conflictPolicyGithub).
+// reopen: If true, issues whose legacy bug is open are reopened. Otherwise
+// issues are only closed.
+// dryRun: If true, report what would be done without changing anything.
+// verbosity: level of output detail.
+func reconcileStates(bugs []Bug, state *migrationState, owner, repo, credFile, policy string, reopen, dryRun bool, verbosity int) (report []stateChange) {
+	issues := getGithubIssues(owner, repo, credFile, "all", -1, verbosity)
+	bar := newProgress("Reconciling issue states", len(issues), verbosity)
+	for _, issue := range issues {
+		bar.Add(1)
+		bug, ok := findBugForIssue(bugs, issue)
+		if !ok {
+			if verbosity > 1 {
+				fmt.Printf("Skipping issue #%d: no legacy bug found\n", issue.Number)
+			}
+			continue
+		}
+		if change, changed := reconcileIssue(bug, issue, state.Bugs[bug.id], owner, repo, credFile, policy, reopen, dryRun); changed {
+			report = append(report, change)
+		}
+	}
+	bar.Clear()
+	if verbosity > 0 {
+		fmt.Println("Reconciling issue states...Finished!")
+	}
+	if !dryRun {
+		saveState(state)
+	}
+	for _, change := range report {
+		fmt.Printf("#%d (bug #%d, %s): %s -> %s: %s\n", change.Issue, change.LegacyId, change.LegacyStatus, change.From, change.To, change.Action)
+	}
+	return
+}
+
+// Opens or closes an issue so that it matches the status of its legacy bug.
+// Returns the change, and false if no change was needed.
+// bug: The legacy bug.
+// issue: The issue to which the bug was migrated.
+// recorded: The migration state of the bug. May be nil.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// policy: How to resolve conflicts (conflictPolicyLegacy or conflictPolicyGithub).
+// reopen: If false, the issue is only changed if it needs closing.
+// dryRun: If true, don't change anything.
+func reconcileIssue(bug Bug, issue octokit.Issue, recorded *bugState, owner, repo, credFile, policy string, reopen, dryRun bool) (stateChange, bool) {
+	current := strings.ToLower(issue.State)
+	desired := "open"
+	if bug.IsClosed() {
+		desired = "closed"
+	}
+	if recorded != nil && !dryRun {
+		recorded.Status = bug.status
+	}
+	if current == desired {
+		if recorded != nil && !dryRun {
+			recorded.IssueState = current
+		}
+		return stateChange{}, false
+	}
+
+	change := stateChange { LegacyId: bug.id, Issue: issue.Number, LegacyStatus: bug.status, From: current, To: desired }
+	if desired == "open" && !reopen {
+		change.Action = "not-reopened"
+		return change, true
+	}
+	if desired == "open" && (recorded == nil || recorded.IssueState == "") {
+		// Without a record of the state we gave the issue, we can't tell
+		// whether it was closed by hand, so treat it as a conflict which is
+		// never overridden.
+		change.Action = "conflict-kept"
+		runLog.Warn(logContext { bug: bug.id, issue: issue.Number }, "Issue is closed on GitHub but legacy status is %s, and no state was recorded for it; not reopening", bug.status)
+		return change, true
+	}
+	if recorded != nil && recorded.IssueState != "" && recorded.IssueState != current {
+		// Someone has opened or closed the issue since we last set its state.
+		if policy != conflictPolicyLegacy {
+			change.Action = "conflict-kept"
+			runLog.Warn(logContext { bug: bug.id, issue: issue.Number }, "Issue was %s on GitHub but legacy status is %s; keeping the GitHub state", current, bug.status)
+			return change, true
+		}
+		change.Action = "conflict-overridden"
+	} else if desired == "closed" {
+		change.Action = "closed"
+	} else {
+		change.Action = "reopened"
+	}
+	if !dryRun {
+		setIssueState(owner, repo, credFile, issue.Number, desired)
+		runLog.Info(logContext { bug: bug.id, issue: issue.Number }, "Changed issue state from %s to %s (%s)", current, desired, change.Action)
+		if recorded != nil {
+			recorded.IssueState = desired
+		}
+	}
+	return change, true
+}
+
+// Gets an issue from GitHub.
+// client: GitHub API client.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// number: Number of the issue.
+func getGithubIssue(client *octokit.Client, owner, repo string, number int) octokit.Issue {
+	issue, result := client.Issues().One(nil, octokit.M{"owner": owner, "repo": repo, "number": number})
+	if result.HasError() {
+		fmt.Printf("Encountered an error when attempting to get issue #%d\n", number)
+		log.Fatal(result)
+	}
+	return *issue
+}
+
+// Writes a report of state changes to a file, as JSON.
+// file: Path of the report.
+// report: The state changes.
+func writeStateReport(file string, report []stateChange) error {
+	if report == nil {
+		report = []stateChange{}
+	}
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCloseIssues(t *testing.T) {
+	fake := startFakeGithub(t)
+	state := testState(t)
+	bugs := testBugs()
+	// Bug 2 is closed, but its issue is still open. Bug 1 is open, but its
+	// issue was closed by hand.
+	open := fake.AddIssue(bugs[0].description, bugs[0].ToString(), "closed")
+	closed := fake.AddIssue(bugs[1].description, bugs[1].ToString(), "open")
+	state.RecordIssue(bugs[0], open, "open")
+	state.RecordIssue(bugs[1], closed, "open")
+
+	report := reconcileStates(bugs, state, "owner", "repo", "", conflictPolicyLegacy, false, false, 0)
+	if fake.Issue(closed).State != "closed" {
+		t.Errorf("Expected issue #%d to be closed", closed)
+	}
+	if fake.Issue(open).State != "closed" {
+		t.Errorf("Expected issue #%d not to be reopened", open)
+	}
+	actions := make(map[int]string)
+	for _, change := range report {
+		actions[change.Issue] = change.Action
+	}
+	if actions[closed] != "closed" || actions[open] != "not-reopened" {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+func TestReconcileStates(t *testing.T) {
+	fake := startFakeGithub(t)
+	state := testState(t)
+	bugs := append(testBugs(), Bug { id: 3, description: "Not recorded", status: "1_New" })
+	// Bug 1 was reopened on the bug tracker. Bug 2 was closed by us, but
+	// reopened by hand. Nothing was recorded for bug 3.
+	reopened := fake.AddIssue(bugs[0].description, bugs[0].ToString(), "closed")
+	byHand := fake.AddIssue(bugs[1].description, bugs[1].ToString(), "open")
+	unrecorded := fake.AddIssue(bugs[2].description, bugs[2].ToString(), "closed")
+	state.RecordIssue(bugs[0], reopened, "closed")
+	state.RecordIssue(bugs[1], byHand, "closed")
+
+	reconcileStates(bugs, state, "owner", "repo", "", conflictPolicyGithub, true, false, 0)
+	if fake.Issue(reopened).State != "open" {
+		t.Errorf("Expected issue #%d to be reopened", reopened)
+	}
+	if fake.Issue(byHand).State != "open" {
+		t.Errorf("Expected the hand-made change to issue #%d to be kept", byHand)
+	}
+	if fake.Issue(unrecorded).State != "closed" {
+		t.Errorf("Expected issue #%d not to be reopened without a state record", unrecorded)
+	}
+	if state.Bugs[1].IssueState != "open" {
+		t.Errorf("Expected the new state of issue #%d to be recorded", reopened)
+	}
+}
+
+func TestIsClosed(t *testing.T) {
+	tests := []struct {
+		status		string
+		closed		bool
+	}{
+		{ "Closed", true },
+		{ "closed", true },
+		{ "4_Review", true },
+		{ "4_review", true },
+		{ "1_New", false },
+		{ "2_Assigned", false },
+		{ "", false },
+	}
+	for _, test := range tests {
+		bug := Bug { status: test.status }
+		if bug.IsClosed() != test.closed {
+			t.Errorf("Status %q: expected IsClosed() to be %v", test.status, test.closed)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The first line of a comment which links an issue to its related issues.
+const relationsHeader = "Related bugs on the legacy bug tracker:"
+
+// The start of the line which lists a bug's subscribers.
+const subscribersHeader = "People who were following this bug on the legacy bug tracker"
+
+// A link between two bugs on the bug tracker.
+type Relationship struct {
+	// ID of the other bug.
+	id			int64
+	// Describes the relationship, e.g. "duplicate".
+	comment		string
+	// Whether the other bug is the parent or child of this one. Empty if neither.
+	direction	string
+}
+
+// If true, each bug's related bugs and subscribers are scraped, which takes
+// two extra requests per bug. Set by --link-related, which is the only thing
+// which uses them.
+var scrapeRelations = false
+
+// Fetches a page from the bug tracker.
+// url: URL of the page.
+func getTrackerPage(url string) (*goquery.Document, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return goquery.NewDocumentFromResponse(response)
+}
+
+// Gets the bugs which are related to a particular bug ID.
+// rootUrl: Root URL of the bug tracker website.
+// Must contain trailing forward slash.
+// e.g. https://www.apsim.info/BugTracker/
+// bugId: ID of the bug.
+func getRelationships(rootUrl string, bugId int) (related []Relationship, err error) {
+	doc, err := getTrackerPage(rootUrl + "relationships.aspx?bgid=" + strconv.Itoa(bugId))
+	if err != nil {
+		return nil, err
+	}
+	// Columns are: id, description, comment, parent or child.
+	doc.Find("table.bugt tr").Each(func(i int, row *goquery.Selection) {
+		// Skip the header row.
+		if i == 0 {
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(row.Find("td:nth-child(1)").Text()), 10, 64)
+		if err != nil || id <= 0 {
+			return
+		}
+		related = append(related, Relationship {
+			id: id,
+			comment: strings.TrimSpace(row.Find("td:nth-child(3)").Text()),
+			direction: strings.TrimSpace(row.Find("td:nth-child(4)").Text()),
+		})
+	})
+	return
+}
+
+// Gets the usernames of the people subscribed to a particular bug ID.
+// rootUrl: Root URL of the bug tracker website.
+// Must contain trailing forward slash.
+// e.g. https://www.apsim.info/BugTracker/
+// bugId: ID of the bug.
+func getSubscribers(rootUrl string, bugId int) (subscribers []string, err error) {
+	doc, err := getTrackerPage(rootUrl + "view_subscribers.aspx?id=" + strconv.Itoa(bugId))
+	if err != nil {
+		return nil, err
+	}
+	doc.Find("table.bugt tr").Each(func(i int, row *goquery.Selection) {
+		// Skip the header row.
+		if i == 0 {
+			return
+		}
+		if user := strings.TrimSpace(row.Find("td:nth-child(1)").Text()); user != "" {
+			subscribers = append(subscribers, user)
+		}
+	})
+	return
+}
+
+// Scrapes the related bugs and subscribers of a bug, if scrapeRelations is
+// set. They're nice to have, so failures are reported as warnings rather
+// than aborting the migration.
+// rootUrl: Root URL of the bug tracker website.
+// bug: The bug.
+func getRelations(rootUrl string, bug *Bug) {
+	if !scrapeRelations {
+		return
+	}
+	var err error
+	if bug.related, err = getRelationships(rootUrl, int(bug.id)); err != nil {
+		summaryReport.Warn(logContext { bug: bug.id }, "Unable to get related bugs: %v", err)
+	}
+	if bug.subscribers, err = getSubscribers(rootUrl, int(bug.id)); err != nil {
+		summaryReport.Warn(logContext { bug: bug.id }, "Unable to get subscribers: %v", err)
+	}
+}
+
+// Reads a mapping of legacy usernames to GitHub logins from a JSON file, e.g.
+// { "hol353": "hol430", "ver078": "ver078" }
+// file: Path to the users file.
+func loadUserMap(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]string
+	if err = json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("Unable to read users file %s: %v", file, err)
+	}
+	return users, nil
+}
+
+// Renders the relationships and subscribers of a bug as a comment, or "" if
+// there is nothing to say.
+// bug: The legacy bug.
+// issues: Issue numbers of the migrated bugs, by legacy bug ID.
+// users: GitHub logins by legacy username. If nil, subscribers are listed by
+// their legacy usernames. Otherwise they're @-mentioned, which notifies them.
+func relationsComment(bug Bug, issues map[int64]int, users map[string]string) string {
+	var lines []string
+	for _, related := range bug.related {
+		line := fmt.Sprintf("- legacy bug %d", related.id)
+		if number, ok := issues[related.id]; ok {
+			// GitHub turns this into a cross-reference on the other issue.
+			line = fmt.Sprintf("- #%d (legacy bug %d)", number, related.id)
+		}
+		if related.direction != "" {
+			line += fmt.Sprintf(", %s", related.direction)
+		}
+		if related.comment != "" {
+			line += fmt.Sprintf(": %s", escapeMarkdown(related.comment))
+		}
+		lines = append(lines, line)
+	}
+
+	var logins []string
+	for _, subscriber := range bug.subscribers {
+		if users == nil {
+			logins = append(logins, escapeMarkdown(subscriber))
+		} else if login, ok := users[subscriber]; ok {
+			logins = append(logins, "@" + login)
+		} else {
+			summaryReport.Warn(logContext { bug: bug.id }, "Legacy user %s isn't in the users file, so they can't be mentioned", subscriber)
+		}
+	}
+	if len(lines) == 0 && len(logins) == 0 {
+		return ""
+	}
+
+	var str strings.Builder
+	if len(lines) > 0 {
+		str.WriteString(relationsHeader + "\n\n")
+		str.WriteString(strings.Join(lines, "\n") + "\n")
+	}
+	if len(logins) > 0 {
+		if len(lines) > 0 {
+			str.WriteString("\n")
+		}
+		if users == nil {
+			str.WriteString(subscribersHeader + ": ")
+		} else {
+			str.WriteString(subscribersHeader + " (subscribe to this issue to keep following it): ")
+		}
+		str.WriteString(strings.Join(logins, ", ") + "\n")
+	}
+	return str.String()
+}
+
+// Links migrated issues to the issues of their related bugs, by posting a
+// comment on each issue which lists them. The comment also lists the bug's
+// subscribers, and optionally mentions them so that they can subscribe to
+// the issue.
+// Issues which already have such a comment are skipped.
+// bugs: The legacy bugs.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// users: GitHub logins by legacy username, for mentioning subscribers. If
+// nil, subscribers aren't mentioned.
+// dryRun: If true, report what would be done without changing anything.
+// verbosity: level of output detail.
+func linkRelatedIssues(bugs []Bug, owner, repo, credFile string, users map[string]string, dryRun bool, verbosity int) {
+	client := newGithubClient(credFile)
+	issues := make(map[int64]int)
+	for _, issue := range getGithubIssues(owner, repo, credFile, "all", -1, verbosity) {
+		if bug, ok := findBugForIssue(bugs, issue); ok {
+			issues[bug.id] = issue.Number
+		}
+	}
+
+	// Process bugs in a stable order, so interrupted runs are easy to follow.
+	ids := make([]int64, 0, len(issues))
+	for id := range issues {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	numLinked := 0
+	bar := newProgress("Linking related issues", len(ids), verbosity)
+	for _, id := range ids {
+		bar.Add(1)
+		bug, _ := findBugById(bugs, id)
+		body := relationsComment(bug, issues, users)
+		if body == "" {
+			continue
+		}
+		number := issues[id]
+		linked := false
+		for _, comment := range getIssueComments(client, owner, repo, number) {
+			if strings.HasPrefix(comment.Body, relationsHeader) || strings.HasPrefix(comment.Body, subscribersHeader) {
+				linked = true
+				break
+			}
+		}
+		if linked {
+			continue
+		}
+		if verbosity > 1 || dryRun {
+			fmt.Printf("Issue #%d (bug #%d):\n%s\n", number, id, body)
+		}
+		if !dryRun {
+			postIssueComment(client, owner, repo, number, body)
+			runLog.Info(logContext { bug: id, issue: number }, "Linked related issues")
+		}
+		numLinked++
+	}
+	bar.Clear()
+	fmt.Printf("Linking related issues...Finished! %d issues linked.\n", numLinked)
+}
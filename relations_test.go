@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRelationsComment(t *testing.T) {
+	bug := Bug { id: 2, related: []Relationship { { id: 1, comment: "caused by", direction: "parent" }, { id: 9 } }, subscribers: []string { "hol353", "ver_078" } }
+	issues := map[int64]int { 1: 10 }
+
+	expected := relationsHeader + "\n\n- #10 (legacy bug 1), parent: caused by\n- legacy bug 9\n\n" + subscribersHeader + ": hol353, ver\\_078\n"
+	if actual := relationsComment(bug, issues, nil); actual != expected {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+
+	// Subscribers are only mentioned when a users file is given.
+	expected = relationsHeader + "\n\n- #10 (legacy bug 1), parent: caused by\n- legacy bug 9\n\n" + subscribersHeader + " (subscribe to this issue to keep following it): @hol430\n"
+	if actual := relationsComment(bug, issues, map[string]string { "hol353": "hol430" }); actual != expected {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+	// Subscribers who aren't in the users file are reported against the bug.
+	found := false
+	for _, warning := range summaryReport.warnings {
+		if warning.context.bug == 2 && strings.Contains(warning.message, "ver_078") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a warning about ver_078 on bug 2, but got %+v", summaryReport.warnings)
+	}
+}
+
+func TestGetRelationsFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	scrapeRelations = true
+	defer func() { scrapeRelations = false }()
+
+	numWarnings := len(summaryReport.warnings)
+	bug := Bug { id: 5 }
+	getRelations(server.URL + "/", &bug)
+	if bug.related != nil || bug.subscribers != nil {
+		t.Errorf("Expected no relations, but got %+v and %+v", bug.related, bug.subscribers)
+	}
+	warnings := summaryReport.warnings[numWarnings:]
+	if len(warnings) != 2 || warnings[0].context.bug != 5 || !strings.Contains(warnings[0].message, "500") {
+		t.Errorf("Expected two warnings about bug 5, but got %+v", warnings)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A summary of what a run did, which can be published as a wiki page or a
+// tracking issue. It's written as Markdown, or as HTML if the report file
+// ends in .html. The report is also written if the run is aborted by
+// log.Fatal, so that the error which stopped it is recorded.
+type migrationReport struct {
+	mutex		sync.Mutex
+	// File to which the report is written. Nothing is written if empty.
+	file		string
+	owner		string
+	repo		string
+	started		time.Time
+	// The bugs being migrated, and the migration state which records what
+	// has happened to them.
+	legacyBugs	[]Bug
+	state		*migrationState
+	bugs		[]reportedBug
+	skipped		[]reportEntry
+	warnings	[]reportEntry
+	errors		[]reportEntry
+	// Messages which have already been reported, so that they aren't repeated.
+	seen		map[string]bool
+}
+
+// What happened to a legacy bug.
+type reportedBug struct {
+	id			int64
+	title		string
+	// Number of the issue, or 0 if it wasn't migrated.
+	issue		int
+	// State of the issue (open or closed).
+	state		string
+	// Number of legacy comments migrated, including the description.
+	comments	int
+	attachments	int
+}
+
+// A skipped item, warning or error.
+type reportEntry struct {
+	context		logContext
+	message		string
+}
+
+// The report of the current run.
+var summaryReport = &migrationReport { started: time.Now(), seen: make(map[string]bool) }
+
+// Records the bugs being migrated. The outcome of each bug is read from the
+// migration state whenever the report is saved, so a report saved when a run
+// is aborted shows every bug which had been posted by then.
+// bugs: The legacy bugs.
+// state: The migration state.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+func (r *migrationReport) AddBugs(bugs []Bug, state *migrationState, owner, repo string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.owner, r.repo = owner, repo
+	r.legacyBugs, r.state = bugs, state
+	r.updateBugs()
+}
+
+// Updates the outcome of each bug from the migration state.
+func (r *migrationReport) updateBugs() {
+	if r.state == nil {
+		return
+	}
+	r.bugs = r.bugs[:0]
+	for _, bug := range r.legacyBugs {
+		reported := reportedBug { id: bug.id, title: bug.description }
+		if recorded, ok := r.state.Bugs[bug.id]; ok {
+			reported.issue = recorded.Issue
+			reported.state = recorded.IssueState
+			if len(bug.comments) > 0 {
+				// The description is the body of the issue.
+				reported.comments = 1
+				reported.attachments = len(bug.comments[0].attachments)
+			}
+			for _, comment := range bug.comments[min(1, len(bug.comments)):] {
+				if recorded.FindComment(comment.id) != nil {
+					reported.comments++
+					reported.attachments += len(comment.attachments)
+				}
+			}
+		}
+		r.bugs = append(r.bugs, reported)
+	}
+}
+
+// Records something which was deliberately not migrated.
+// context: What was skipped.
+// format: Format string of the reason.
+// args: Arguments of the format string.
+func (r *migrationReport) Skip(context logContext, format string, args ...interface{}) {
+	r.add(&r.skipped, context, fmt.Sprintf(format, args...))
+}
+
+// Records a problem which didn't stop the run, and logs it.
+// context: What the warning is about.
+// format: Format string of the message.
+// args: Arguments of the format string.
+func (r *migrationReport) Warn(context logContext, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if r.add(&r.warnings, context, message) {
+		runLog.Warn(context, "%s", message)
+	}
+}
+
+// Records an error, and logs it.
+// context: What the error is about.
+// format: Format string of the message.
+// args: Arguments of the format string.
+func (r *migrationReport) Error(context logContext, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if r.add(&r.errors, context, message) {
+		runLog.Error(context, "%s", message)
+	}
+}
+
+// Adds an entry to one of the lists, unless it's already been reported.
+// Returns false if it had already been reported.
+func (r *migrationReport) add(list *[]reportEntry, context logContext, message string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := fmt.Sprintf("%p %+v %s", list, context, message)
+	if r.seen[key] {
+		return false
+	}
+	r.seen[key] = true
+	*list = append(*list, reportEntry { context, message })
+	return true
+}
+
+// Records output of the standard logger as an error and saves the report,
+// since log.Fatal exits straight afterwards. Use with io.MultiWriter.
+func (r *migrationReport) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	if len(message) > 20 {
+		if _, err := time.Parse("2006/01/02 15:04:05", message[:19]); err == nil {
+			message = message[20:]
+		}
+	}
+	r.add(&r.errors, logContext{}, message)
+	r.Save()
+	return len(p), nil
+}
+
+// Writes the report to its file, if it has one. Errors are printed rather
+// than returned, since the report shouldn't hide the outcome of the run.
+func (r *migrationReport) Save() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == "" {
+		return
+	}
+	r.updateBugs()
+	var text string
+	if strings.EqualFold(filepath.Ext(r.file), ".html") {
+		text = r.html()
+	} else {
+		text = r.markdown()
+	}
+	if err := ioutil.WriteFile(r.file, []byte(text), 0644); err != nil {
+		fmt.Printf("Unable to write report %s: %v\n", r.file, err)
+	}
+}
+
+// Gets the URL of an issue.
+// number: Number of the issue.
+func (r *migrationReport) issueUrl(number int) string {
+	return fmt.Sprintf("%s%s/%s/issues/%d", githubWebUrl(), r.owner, r.repo, number)
+}
+
+// Gets a one-line summary of the report.
+func (r *migrationReport) summary() string {
+	migrated := 0
+	for _, bug := range r.bugs {
+		if bug.issue > 0 {
+			migrated++
+		}
+	}
+	return fmt.Sprintf("%d of %d bugs migrated, %d items skipped, %d warnings, %d errors.", migrated, len(r.bugs), len(r.skipped), len(r.warnings), len(r.errors))
+}
+
+// A list of entries in the report.
+type reportSection struct {
+	title		string
+	entries		[]reportEntry
+}
+
+// Gets the lists of skipped items, warnings and errors.
+func (r *migrationReport) sections() []reportSection {
+	return []reportSection { { "Skipped", r.skipped }, { "Warnings", r.warnings }, { "Errors", r.errors } }
+}
+
+// Describes what an entry is about, e.g. "Bug #12, comment 345, issue #67".
+// context: What the entry is about.
+func describeContext(context logContext) string {
+	var parts []string
+	if context.bug > 0 {
+		parts = append(parts, fmt.Sprintf("Bug #%d", context.bug))
+	}
+	if context.comment > 0 {
+		parts = append(parts, fmt.Sprintf("comment %d", context.comment))
+	}
+	if context.issue > 0 {
+		parts = append(parts, fmt.Sprintf("issue #%d", context.issue))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Renders the report as Markdown.
+func (r *migrationReport) markdown() string {
+	var str strings.Builder
+	str.WriteString("# Migration report\n\n")
+	str.WriteString(fmt.Sprintf("Run started %s, report written %s.\n\n", r.started.Format(time.RFC1123), time.Now().Format(time.RFC1123)))
+	str.WriteString(r.summary() + "\n")
+
+	if len(r.bugs) > 0 {
+		str.WriteString("\n## Bugs\n\n")
+		str.WriteString("| Legacy bug | Title | Issue | State | Comments | Attachments |\n")
+		str.WriteString("|---|---|---|---|---|---|\n")
+		for _, bug := range r.bugs {
+			issue := "not migrated"
+			if bug.issue > 0 {
+				issue = fmt.Sprintf("[#%d](%s)", bug.issue, r.issueUrl(bug.issue))
+			}
+			title := strings.Replace(escapeMarkdown(bug.title), "|", "\\|", -1)
+			str.WriteString(fmt.Sprintf("| %d | %s | %s | %s | %d | %d |\n", bug.id, title, issue, bug.state, bug.comments, bug.attachments))
+		}
+	}
+
+	for _, section := range r.sections() {
+		str.WriteString(fmt.Sprintf("\n## %s\n\n", section.title))
+		if len(section.entries) == 0 {
+			str.WriteString("None.\n")
+		}
+		for _, entry := range section.entries {
+			line := escapeMarkdown(entry.message)
+			if about := describeContext(entry.context); about != "" {
+				line = about + ": " + line
+			}
+			str.WriteString("- " + line + "\n")
+		}
+	}
+	return str.String()
+}
+
+// Renders the report as an HTML page.
+func (r *migrationReport) html() string {
+	var str strings.Builder
+	str.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>Migration report</title></head>\n<body>\n")
+	str.WriteString("<h1>Migration report</h1>\n")
+	str.WriteString(fmt.Sprintf("<p>Run started %s, report written %s.</p>\n", r.started.Format(time.RFC1123), time.Now().Format(time.RFC1123)))
+	str.WriteString(fmt.Sprintf("<p>%s</p>\n", html.EscapeString(r.summary())))
+
+	if len(r.bugs) > 0 {
+		str.WriteString("<h2>Bugs</h2>\n<table>\n")
+		str.WriteString("<tr><th>Legacy bug</th><th>Title</th><th>Issue</th><th>State</th><th>Comments</th><th>Attachments</th></tr>\n")
+		for _, bug := range r.bugs {
+			issue := "not migrated"
+			if bug.issue > 0 {
+				issue = fmt.Sprintf("<a href=\"%s\">#%d</a>", html.EscapeString(r.issueUrl(bug.issue)), bug.issue)
+			}
+			str.WriteString(fmt.Sprintf("<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%d</td></tr>\n", bug.id, html.EscapeString(bug.title), issue, html.EscapeString(bug.state), bug.comments, bug.attachments))
+		}
+		str.WriteString("</table>\n")
+	}
+
+	for _, section := range r.sections() {
+		str.WriteString(fmt.Sprintf("<h2>%s</h2>\n", section.title))
+		if len(section.entries) == 0 {
+			str.WriteString("<p>None.</p>\n")
+			continue
+		}
+		str.WriteString("<ul>\n")
+		for _, entry := range section.entries {
+			line := html.EscapeString(entry.message)
+			if about := describeContext(entry.context); about != "" {
+				line = html.EscapeString(about) + ": " + line
+			}
+			str.WriteString("<li>" + line + "</li>\n")
+		}
+		str.WriteString("</ul>\n")
+	}
+	str.WriteString("</body>\n</html>\n")
+	return str.String()
+}
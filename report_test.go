@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportShowsProgress(t *testing.T) {
+	report := &migrationReport { file: filepath.Join(t.TempDir(), "report.md"), started: time.Now(), seen: make(map[string]bool) }
+	state := testState(t)
+	bugs := testBugs()
+	report.AddBugs(bugs, state, "owner", "repo")
+
+	// Bugs posted after the report was started should be in the report, even
+	// if the run is aborted before it finishes.
+	state.RecordIssue(bugs[0], 7, "open")
+	report.Save()
+	data, err := ioutil.ReadFile(report.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	if !strings.Contains(text, "| 1 | ") || !strings.Contains(text, "[#7](https://github.com/owner/repo/issues/7)") {
+		t.Errorf("Expected bug 1 to be reported as issue #7:\n%s", text)
+	}
+	if !strings.Contains(text, "| not migrated |") {
+		t.Errorf("Expected bug 2 to be reported as not migrated:\n%s", text)
+	}
+}
+
+func TestGithubWebUrl(t *testing.T) {
+	original := githubApiUrl
+	defer func() { githubApiUrl = original }()
+	tests := map[string]string {
+		"https://api.github.com/": "https://github.com/",
+		"https://github.example.com/api/v3/": "https://github.example.com/",
+		"http://127.0.0.1:8080/": "http://127.0.0.1:8080/",
+	}
+	for api, expected := range tests {
+		githubApiUrl = api
+		if actual := githubWebUrl(); actual != expected {
+			t.Errorf("Expected the website for %s to be %s, but got %s", api, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/octokit/go-octokit/octokit"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A rule which rewrites the bodies of issues and comments. A rule is either
+// a regular expression and its replacement (which may refer to capture
+// groups as $1 etc.), or the name of a built-in transform.
+type rewriteRule struct {
+	Pattern		string	`json:"pattern,omitempty"`
+	Replace		string	`json:"replace,omitempty"`
+	Transform	string	`json:"transform,omitempty"`
+	re			*regexp.Regexp
+}
+
+// A built-in transform. Returns the rewritten body.
+// body: The body of an issue or comment.
+// issue: The issue to which the body belongs.
+type transform func(r *rewriter, body string, issue octokit.Issue) (string, error)
+
+// Built-in transforms, by name.
+var transforms = map[string]transform {
+	// Removes tabs, which were incorrectly inserted into some bugs.
+	"strip-tabs": func(r *rewriter, body string, issue octokit.Issue) (string, error) {
+		return strings.Replace(body, "\t", "", -1), nil
+	},
+	// Replaces links to attachments on the legacy bug tracker with links to
+	// the reuploaded attachments.
+	"legacy-attachment-links": rewriteLegacyAttachmentLinks,
+}
+
+// The rules used by the old --fix-links command. I forgot to put https:// in
+// front of attachment links.
+var fixLinksRules = []rewriteRule {
+	{ Pattern: `(\[[^\]]+\])\(www.apsim.info`, Replace: "$1(https://www.apsim.info" },
+}
+
+// The rules used by the old --fix-links2 command.
+var fixLinks2Rules = []rewriteRule {
+	{ Transform: "legacy-attachment-links" },
+}
+
+// The rules used by the old --fix-formatting command.
+var fixFormattingRules = []rewriteRule {
+	{ Transform: "strip-tabs" },
+}
+
+// Applies rewrite rules to issues and comments.
+type rewriter struct {
+	rules		[]rewriteRule
+	// Fetches the legacy bugs. Only called if a rule needs them.
+	fetchBugs	func() []Bug
+	bugs		[]Bug
+	// Directory in which downloaded attachments are cached.
+	cacheDir	string
+	// Paths of the attachments which were uploaded by content (to
+	// BugAttachments/sha256/<hash>/), by hash.
+	uploaded	map[string]string
+}
+
+// Reads rewrite rules from a JSON file, e.g.
+// [
+//     { "pattern": "http://old\\.example\\.com", "replace": "https://example.com" },
+//     { "transform": "strip-tabs" }
+// ]
+// file: Path to the rules file.
+func loadRewriteRules(file string) ([]rewriteRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []rewriteRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Unable to read rules file %s: %v", file, err)
+	}
+	return rules, nil
+}
+
+// Creates a rewriter, checking that all of its rules are valid.
+// rules: The rules to apply, in order.
+// fetchBugs: Fetches the legacy bugs, if a rule needs them.
+func newRewriter(rules []rewriteRule, fetchBugs func() []Bug) (*rewriter, error) {
+	for i := range rules {
+		if (rules[i].Pattern == "") == (rules[i].Transform == "") {
+			return nil, fmt.Errorf("Rewrite rule %d must have either a pattern or a transform", i + 1)
+		}
+		if rules[i].Transform != "" {
+			if _, ok := transforms[rules[i].Transform]; !ok {
+				return nil, fmt.Errorf("Unknown transform: %s", rules[i].Transform)
+			}
+			continue
+		}
+		re, err := regexp.Compile(rules[i].Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %s: %v", rules[i].Pattern, err)
+		}
+		rules[i].re = re
+	}
+	return &rewriter { rules: rules, fetchBugs: fetchBugs }, nil
+}
+
+// Gets the legacy bugs, fetching them the first time they're needed.
+func (r *rewriter) getBugs() []Bug {
+	if r.bugs == nil {
+		r.bugs = r.fetchBugs()
+	}
+	return r.bugs
+}
+
+// Applies all rules to the body of an issue or comment.
+// body: The body.
+// issue: The issue to which the body belongs.
+func (r *rewriter) Apply(body string, issue octokit.Issue) (string, error) {
+	for _, rule := range r.rules {
+		if rule.re != nil {
+			body = rule.re.ReplaceAllString(body, rule.Replace)
+			continue
+		}
+		var err error
+		body, err = transforms[rule.Transform](r, body, issue)
+		if err != nil {
+			return "", err
+		}
+	}
+	return body, nil
+}
+
+// Parses a range of issue numbers such as "10", "10-200" or "10-".
+// Returns 0 for an open end.
+// scope: The range.
+func parseIssueRange(scope string) (first, last int) {
+	parts := strings.SplitN(scope, "-", 2)
+	first = int(parseInt(parts[0]))
+	if len(parts) == 1 {
+		return first, first
+	}
+	if parts[1] != "" {
+		last = int(parseInt(parts[1]))
+	}
+	return
+}
+
+// Applies rewrite rules to the bodies of issues and their comments, and
+// updates any which change.
+// r: The rewriter.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// first: Number of the first issue to rewrite. 0 for no lower limit.
+// last: Number of the last issue to rewrite. 0 for no upper limit.
+// dryRun: If true, show the changes without making them.
+// verbosity: level of output detail.
+func rewriteIssues(r *rewriter, owner, repo, credFile string, first, last int, dryRun bool, verbosity int) {
+	client := newGithubClient(credFile)
+	issues := getGithubIssues(owner, repo, credFile, "all", -1, verbosity)
+	numChanges := 0
+	bar := newProgress("Rewriting issues", len(issues), verbosity)
+	for _, issue := range issues {
+		bar.Add(1)
+		if (first > 0 && issue.Number < first) || (last > 0 && issue.Number > last) {
+			continue
+		}
+
+		newBody, err := r.Apply(issue.Body, issue)
+		if err != nil {
+			fmt.Printf("Unable to rewrite issue #%d: %v\n", issue.Number, err)
+			summaryReport.Error(logContext { issue: issue.Number }, "Unable to rewrite issue: %v", err)
+		} else if newBody != issue.Body {
+			numChanges++
+			if verbosity > 0 {
+				fmt.Printf("Issue #%d:\n%s\n", issue.Number, lineDiff(issue.Body, newBody))
+			}
+			if !dryRun {
+				m := octokit.M{"owner": owner, "repo": repo, "number": issue.Number}
+				_, result := client.Issues().Update(nil, m, octokit.IssueParams {Body: newBody})
+				if result.HasError() {
+					log.Fatal(result)
+				}
+				runLog.Info(logContext { issue: issue.Number }, "Rewrote issue body")
+			}
+		}
+
+		for commentNo, comment := range getIssueComments(client, owner, repo, issue.Number) {
+			newBody, err := r.Apply(comment.Body, issue)
+			if err != nil {
+				fmt.Printf("Unable to rewrite comment %d of issue #%d: %v\n", commentNo + 1, issue.Number, err)
+				summaryReport.Error(logContext { issue: issue.Number }, "Unable to rewrite comment %d: %v", commentNo + 1, err)
+				continue
+			}
+			if newBody == comment.Body {
+				continue
+			}
+			numChanges++
+			if verbosity > 0 {
+				fmt.Printf("Comment %d of issue #%d:\n%s\n", commentNo + 1, issue.Number, lineDiff(comment.Body, newBody))
+			}
+			if !dryRun {
+				m := octokit.M{"owner": owner, "repo": repo, "id": comment.ID}
+				_, result := client.IssueComments().Update(nil, m, octokit.M{"body": newBody})
+				if result.HasError() {
+					log.Fatal(result)
+				}
+				runLog.Info(logContext { issue: issue.Number }, "Rewrote comment %d", commentNo + 1)
+			}
+		}
+	}
+	bar.Clear()
+	if dryRun {
+		fmt.Printf("Rewriting issues...Finished! %d changes would be made.\n", numChanges)
+	} else {
+		fmt.Printf("Rewriting issues...Finished! %d changes made.\n", numChanges)
+	}
+}
+
+// Produces a line-by-line diff of two strings. Removed lines are prefixed
+// with '-', added lines with '+' and unchanged lines with ' '.
+// before: The original text.
+// after: The new text.
+func lineDiff(before, after string) string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a) + 1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b) + 1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i + 1][j + 1] + 1
+			} else {
+				lcs[i][j] = maxInt(lcs[i + 1][j], lcs[i][j + 1])
+			}
+		}
+	}
+
+	var str strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			str.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i + 1][j] >= lcs[i][j + 1]):
+			str.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			str.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return str.String()
+}
+
+// Replaces links to attachments on the legacy bug tracker with links to the
+// copies which were uploaded to www.apsim.info/BugAttachments. Attachments
+// which were uploaded by content are found by hashing their cached copies,
+// and the rest are assumed to be in a directory named after their comment.
+func rewriteLegacyAttachmentLinks(r *rewriter, body string, issue octokit.Issue) (string, error) {
+	re := regexp.MustCompile(`\[([^\]]+)\]\(https://www.apsim.info/BugTracker[^\)]+\)`)
+	if !re.MatchString(body) {
+		return body, nil
+	}
+
+	bugs := r.getBugs()
+	var bug Bug
+	if legacyId := getLegacyId(issue); legacyId >= 0 {
+		var ok bool
+		if bug, ok = findBugById(bugs, int64(legacyId)); !ok {
+			return "", fmt.Errorf("Unable to find legacy bug %d", legacyId)
+		}
+	} else {
+		var ok bool
+		if bug, ok = findBugByTitle(bugs, issue.Title); !ok {
+			return "", fmt.Errorf("Unable to find legacy bug with title %s", issue.Title)
+		}
+	}
+
+	var err error
+	body = re.ReplaceAllStringFunc(body, func(link string) string {
+		name := re.FindStringSubmatch(link)[1]
+		comment, ok := findCommentWithAttachment(bug.comments, name)
+		if !ok {
+			err = fmt.Errorf("Unable to find comment with attachment %s on legacy bug %d", name, bug.id)
+			return link
+		}
+		if uploaded := r.uploadedPath(comment, name); uploaded != "" {
+			return fmt.Sprintf("[%s](https://www.apsim.info/%s)", name, escapeMarkdownUrl(uploaded))
+		}
+		return fmt.Sprintf("[%s](https://www.apsim.info/BugAttachments/%d/%s)", name, comment.id, url.PathEscape(sanitiseFileName(name)))
+	})
+	return body, err
+}
+
+// Gets the path to which an attachment was uploaded by content, or "" if it
+// wasn't (or its cached copy is missing, so its hash is unknown).
+// comment: The comment to which the file was attached.
+// name: Name of the file.
+func (r *rewriter) uploadedPath(comment Comment, name string) string {
+	if len(r.uploaded) == 0 {
+		return ""
+	}
+	for _, attachment := range comment.attachments {
+		if attachment.name != name {
+			continue
+		}
+		hash, err := hashFile(path.Join(r.cacheDir, strconv.Itoa(int(comment.id)), attachment.GetCleanFileName()))
+		if err != nil {
+			return ""
+		}
+		return r.uploaded[hash]
+	}
+	return ""
+}
+
+// Finds the comment to which a file was attached.
+// comments: Comments on a legacy bug.
+// name: Name of the file.
+func findCommentWithAttachment(comments []Comment, name string) (Comment, bool) {
+	for _, comment := range comments {
+		for _, attachment := range comment.attachments {
+			if attachment.name == name {
+				return comment, true
+			}
+		}
+	}
+	for _, comment := range comments {
+		if strings.Contains(comment.text, name) {
+			return comment, true
+		}
+	}
+	return Comment{}, false
+}
+
+// Finds the bug with the given ID. Returns false if there is no such bug.
+// bugs: list of bugs.
+// id: ID of the bug.
+func findBugById(bugs []Bug, id int64) (Bug, bool) {
+	for _, bug := range bugs {
+		if bug.id == id {
+			return bug, true
+		}
+	}
+	return Bug{}, false
+}
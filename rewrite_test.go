@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/octokit/go-octokit/octokit"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixCommands(t *testing.T) {
+	fake := startFakeGithub(t)
+	bugs := []Bug {
+		{ id: 5, comments: []Comment {
+			{ id: 50, text: "Description" },
+			{ id: 51, attachments: []Attachment { { name: "crash log.txt" } } },
+		} },
+	}
+	number := fake.AddIssue("Crash", "Legacy Bug ID: 5\n\tIndented\n", "open",
+		"[crash log.txt](www.apsim.info/BugAttachments/51/crash%20log.txt)",
+		"[crash log.txt](https://www.apsim.info/BugTracker/view_attachment.aspx?id=7&bug_id=5)")
+
+	var rules []rewriteRule
+	rules = append(rules, fixLinksRules...)
+	rules = append(rules, fixLinks2Rules...)
+	rules = append(rules, fixFormattingRules...)
+	r, err := newRewriter(rules, func() []Bug { return bugs })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dry run doesn't change anything.
+	rewriteIssues(r, "owner", "repo", "", 0, 0, true, 0)
+	if fake.Issue(number).Body != "Legacy Bug ID: 5\n\tIndented\n" {
+		t.Errorf("Dry run changed the issue: %q", fake.Issue(number).Body)
+	}
+
+	rewriteIssues(r, "owner", "repo", "", 0, 0, false, 0)
+	if body := fake.Issue(number).Body; body != "Legacy Bug ID: 5\nIndented\n" {
+		t.Errorf("Unexpected issue body: %q", body)
+	}
+	expected := []string {
+		"[crash log.txt](https://www.apsim.info/BugAttachments/51/crash%20log.txt)",
+		"[crash log.txt](https://www.apsim.info/BugAttachments/51/crash_log.txt)",
+	}
+	comments := fake.CommentBodies(number)
+	if len(comments) != len(expected) {
+		t.Fatalf("Expected %d comments, but found %d", len(expected), len(comments))
+	}
+	for i := range expected {
+		if comments[i] != expected[i] {
+			t.Errorf("Comment %d: expected %q, but got %q", i + 1, expected[i], comments[i])
+		}
+	}
+}
+
+func TestNewRewriterRejectsEmptyRules(t *testing.T) {
+	for _, rule := range []rewriteRule { {}, { Replace: "x" }, { Pattern: "a", Transform: "strip-tabs" } } {
+		if _, err := newRewriter([]rewriteRule { rule }, nil); err == nil {
+			t.Errorf("Expected rule %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestLegacyAttachmentLinksByContent(t *testing.T) {
+	cacheDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cacheDir, "51"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "51", "crash_log.txt"), []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFile(filepath.Join(cacheDir, "51", "crash_log.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bugs := []Bug {
+		{ id: 5, comments: []Comment {
+			{ id: 50, text: "Description" },
+			{ id: 51, attachments: []Attachment { { name: "crash log.txt" }, { name: "notes.doc" } } },
+		} },
+	}
+	r, err := newRewriter(fixLinks2Rules, func() []Bug { return bugs })
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.cacheDir = cacheDir
+	r.uploaded = map[string]string { hash: "BugAttachments/sha256/" + hash + "/crash_log.txt" }
+
+	issue := octokit.Issue { Body: "Legacy Bug ID: 5" }
+	body := "[crash log.txt](https://www.apsim.info/BugTracker/view_attachment.aspx?id=7) [notes.doc](https://www.apsim.info/BugTracker/view_attachment.aspx?id=8)"
+	actual, err := r.Apply(body, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// notes.doc isn't in the cache, so it's assumed to be in its comment's directory.
+	expected := "[crash log.txt](https://www.apsim.info/BugAttachments/sha256/" + hash + "/crash_log.txt) [notes.doc](https://www.apsim.info/BugAttachments/51/notes.doc)"
+	if actual != expected {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Phrases which are common in spam, and rare in discussions of APSIM.
+var spamPhrases = []string {
+	"cheap", "replica", "watches", "viagra", "cialis", "casino", "poker", "betting", "loan", "payday",
+	"weight loss", "diet pills", "essay writing", "buy now", "click here", "free shipping",
+	"discount", "best price", "seo services", "backlinks", "escort", "porn",
+}
+
+// Matches any of the spam phrases as whole words, so that e.g. "loan" doesn't
+// match "sloane", and "poker" doesn't match "stoker".
+var spamPhrasePattern = regexp.MustCompile(`(?i)\b(` + strings.Join(spamPhrases, "|") + `)\b`)
+
+// Matches a link in the text of a comment.
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)\S+`)
+
+const (
+	// Comments with at least this score are flagged as suspicious.
+	spamThreshold = 2
+	// Comments with at least this many words per link aren't considered to
+	// be mostly links.
+	minWordsPerLink = 15
+	// Text shorter than this isn't checked for duplicates, since short
+	// comments such as "Fixed." are often repeated legitimately.
+	minDuplicateLength = 20
+	// Authors who post on at least this many bugs within burstWindow, and
+	// never report any bugs, are considered suspicious.
+	burstPosts = 3
+	burstWindow = 24 * time.Hour
+)
+
+// A comment which looks like spam.
+type spamCandidate struct {
+	LegacyId	int64		`json:"legacyId"`
+	CommentId	int64		`json:"commentId"`
+	Author		string		`json:"author"`
+	Date		time.Time	`json:"date"`
+	Score		int			`json:"score"`
+	// Why the comment looks like spam.
+	Reasons		[]string	`json:"reasons"`
+	Excerpt		string		`json:"excerpt"`
+}
+
+// Looks for spam amongst the comments on some bugs, using a few heuristics:
+// links, spam phrases, authors who post in bursts and text which is posted
+// on several bugs. This is only a guide - the results need to be reviewed
+// before the comments are excluded.
+// Returns the suspicious comments, most suspicious first.
+// bugs: The bugs.
+func detectSpam(bugs []Bug) (candidates []spamCandidate) {
+	// Work out which authors reported bugs, and which bugs each text and
+	// author appears on.
+	reporters := make(map[string]bool)
+	textBugs := make(map[string]map[int64]bool)
+	authorPosts := make(map[string][]Comment)
+	authorBugs := make(map[string]map[int64]bool)
+	for _, bug := range bugs {
+		reporters[strings.ToLower(bug.author)] = true
+		for _, comment := range bug.comments {
+			text := normaliseSpamText(comment.text)
+			if textBugs[text] == nil {
+				textBugs[text] = make(map[int64]bool)
+			}
+			textBugs[text][bug.id] = true
+			author := strings.ToLower(comment.author)
+			authorPosts[author] = append(authorPosts[author], comment)
+			if authorBugs[author] == nil {
+				authorBugs[author] = make(map[int64]bool)
+			}
+			authorBugs[author][bug.id] = true
+		}
+	}
+	bursts := make(map[string]bool)
+	for author, posts := range authorPosts {
+		if !reporters[author] && len(authorBugs[author]) >= burstPosts && postsInBurst(posts) {
+			bursts[author] = true
+		}
+	}
+
+	for _, bug := range bugs {
+		for _, comment := range bug.comments {
+			score := 0
+			var reasons []string
+			// Phrases like "discount" turn up in genuine comments, so they
+			// aren't enough to flag a comment on their own.
+			var phrases []string
+			seen := make(map[string]bool)
+			for _, phrase := range spamPhrasePattern.FindAllString(comment.text, -1) {
+				if phrase = strings.ToLower(phrase); !seen[phrase] {
+					seen[phrase] = true
+					phrases = append(phrases, phrase)
+				}
+			}
+			if len(phrases) > 0 {
+				score++
+				reasons = append(reasons, fmt.Sprintf("contains spam phrases: %s", strings.Join(phrases, ", ")))
+			}
+
+			links := len(linkPattern.FindAllString(comment.text, -1))
+			words := len(strings.Fields(comment.text))
+			if links > 0 && words / links < minWordsPerLink {
+				score += 2
+				reasons = append(reasons, fmt.Sprintf("mostly links (%d links in %d words)", links, words))
+			} else if links >= 3 {
+				score++
+				reasons = append(reasons, fmt.Sprintf("contains %d links", links))
+			}
+
+			author := strings.ToLower(comment.author)
+			if bursts[author] {
+				score++
+				reasons = append(reasons, fmt.Sprintf("author never reported a bug, but commented on %d bugs in a short time", len(authorBugs[author])))
+			}
+			if len(authorPosts[author]) == 1 && !reporters[author] && links > 0 {
+				score++
+				reasons = append(reasons, "author's only post, and it contains a link")
+			}
+
+			text := normaliseSpamText(comment.text)
+			if len(text) >= minDuplicateLength && len(textBugs[text]) > 1 {
+				score += 2
+				reasons = append(reasons, fmt.Sprintf("same text posted on %d bugs", len(textBugs[text])))
+			}
+
+			if score >= spamThreshold {
+				candidates = append(candidates, spamCandidate {
+					LegacyId: bug.id,
+					CommentId: comment.id,
+					Author: comment.author,
+					Date: comment.date,
+					Score: score,
+					Reasons: reasons,
+					Excerpt: excerpt(comment.text),
+				})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	return
+}
+
+// Checks whether an author made burstPosts posts within burstWindow.
+// posts: The author's posts.
+func postsInBurst(posts []Comment) bool {
+	dates := make([]time.Time, len(posts))
+	for i, post := range posts {
+		dates[i] = post.date
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].Before(dates[j]) })
+	for i := 0; i + burstPosts - 1 < len(dates); i++ {
+		if dates[i + burstPosts - 1].Sub(dates[i]) <= burstWindow {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalises the text of a comment for detecting duplicates.
+// text: The text.
+func normaliseSpamText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(stripNonBreakingSpaces(text))), " ")
+}
+
+// Writes the suspicious comments to a file as JSON.
+// file: Path of the report.
+// candidates: The suspicious comments.
+func writeSpamReport(file string, candidates []spamCandidate) error {
+	if candidates == nil {
+		candidates = []spamCandidate{}
+	}
+	data, err := json.MarshalIndent(candidates, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
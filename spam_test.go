@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetectSpam(t *testing.T) {
+	date := time.Date(2012, 1, 2, 10, 0, 0, 0, time.UTC)
+	bugs := []Bug {
+		{ id: 1, author: "hol353", comments: []Comment {
+			{ id: 10, author: "hol353", date: date, text: "Wheat yields are too low." },
+			// Spam phrases alone aren't enough.
+			{ id: 11, author: "ver078", date: date, text: "Is there a discount on the cheap licence?" },
+			// Only whole words match.
+			{ id: 12, author: "ver078", date: date, text: "Sloane's soil water data has been added." },
+			// A spam phrase and a link to a post which is mostly links.
+			{ id: 13, author: "spammer", date: date, text: "Cheap watches www.example.com" },
+		} },
+	}
+	candidates := detectSpam(bugs)
+	if len(candidates) != 1 || candidates[0].CommentId != 13 {
+		t.Fatalf("Expected only comment 13 to be flagged, but got %+v", candidates)
+	}
+	if len(candidates[0].Reasons) == 0 || candidates[0].Reasons[0] != "contains spam phrases: cheap, watches" {
+		t.Errorf("Unexpected reasons: %q", candidates[0].Reasons)
+	}
+}
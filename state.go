@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Records what has been migrated to GitHub, so that later runs can tell
+// which bugs and comments are new or have changed since.
+type migrationState struct {
+	// Time at which the state was last synchronised with the bug tracker.
+	LastSync	time.Time				`json:"lastSync"`
+	Bugs		map[int64]*bugState		`json:"bugs"`
+	// Path of the file from which the state was loaded.
+	file		string
+}
+
+// The migration state of a single bug.
+type bugState struct {
+	Issue		int					`json:"issue"`
+	// Legacy status of the bug when it was last synchronised.
+	Status		string				`json:"status"`
+	// State (open/closed) which was last set on the GitHub issue.
+	IssueState	string				`json:"issueState"`
+	// Hash of the bug (see Bug.Hash), to detect edits to the bug.
+	BodyHash	string				`json:"bodyHash"`
+	// True if the issue has been locked.
+	Locked		bool				`json:"locked,omitempty"`
+	Comments	[]commentState		`json:"comments"`
+}
+
+// The migration state of a single legacy comment.
+type commentState struct {
+	Id			int64		`json:"id"`
+	Date		time.Time	`json:"date"`
+	// ID of the GitHub comment to which it was posted.
+	GithubId	int			`json:"githubId"`
+	// Hash of the comment's contents, to detect edits.
+	Hash		string		`json:"hash"`
+}
+
+// Reads the migration state from a file. If the file doesn't exist, an
+// empty state is returned.
+// file: Path of the state file.
+func loadState(file string) (*migrationState, error) {
+	state := &migrationState { Bugs: make(map[int64]*bugState), file: file }
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Bugs == nil {
+		state.Bugs = make(map[int64]*bugState)
+	}
+	return state, nil
+}
+
+// Writes the migration state back to the file it was loaded from. The file
+// is replaced atomically so that an interrupted run can't corrupt it.
+func (s *migrationState) Save() error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(s.file + ".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(s.file + ".tmp", s.file)
+}
+
+// Records that a bug has been posted as an issue.
+// bug: The bug.
+// issue: Number of the issue.
+// issueState: State of the issue (open/closed).
+func (s *migrationState) RecordIssue(bug Bug, issue int, issueState string) {
+	s.Bugs[bug.id] = &bugState {
+		Issue: issue,
+		Status: bug.status,
+		IssueState: issueState,
+		BodyHash: bug.Hash(),
+	}
+}
+
+// Records that a comment has been posted to an issue.
+// bugId: ID of the legacy bug.
+// comment: The legacy comment.
+// githubId: ID of the GitHub comment.
+func (s *migrationState) RecordComment(bugId int64, comment Comment, githubId int) {
+	bug := s.Bugs[bugId]
+	for i := range bug.Comments {
+		if bug.Comments[i].Id == comment.id {
+			bug.Comments[i] = commentState { comment.id, comment.date, githubId, comment.Hash() }
+			return
+		}
+	}
+	bug.Comments = append(bug.Comments, commentState { comment.id, comment.date, githubId, comment.Hash() })
+}
+
+// Finds the recorded state of a comment. Returns nil if the comment hasn't
+// been posted.
+// id: ID of the legacy comment.
+func (b *bugState) FindComment(id int64) *commentState {
+	for i := range b.Comments {
+		if b.Comments[i].Id == id {
+			return &b.Comments[i]
+		}
+	}
+	return nil
+}
+
+// Computes a short hash of some text, for detecting changes.
+// text: The text.
+func hashText(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"github.com/octokit/go-octokit/octokit"
+	"log"
+	"strings"
+	"time"
+)
+
+// Brings the GitHub issues up to date with the legacy bug tracker. Bugs which
+// haven't been migrated are posted, comments which have been added since the
+// last run are posted to the existing issues, comments and bugs which have
+// been edited are updated, and issues are opened or closed if the status of
+// their bug has changed.
+// bugs: The legacy bugs.
+// state: The migration state. If it's empty, it is rebuilt from the issues on GitHub.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// cacheDir: Directory in which downloaded attachments are cached.
+// store: If not nil, attachments will be downloaded from BugTracker, and uploaded to this store.
+// policy: How to resolve conflicts when an issue's state was changed by hand (conflictPolicyLegacy or conflictPolicyGithub).
+// history: How the history of new bugs is migrated (historyNone, historyTimeline or historyLabels).
+// verbosity: level of output detail.
+func syncIssues(bugs []Bug, state *migrationState, owner, repo, credFile, cacheDir string, store *contentAddressedStore, policy, history string, verbosity int) {
+	if len(state.Bugs) == 0 {
+		rebuildState(bugs, state, owner, repo, credFile, verbosity)
+	}
+	if !state.LastSync.IsZero() {
+		fmt.Printf("Last synchronised at %s\n", state.LastSync.Format(time.RFC1123))
+	}
+
+	client := newGithubClient(credFile)
+	numNew, numComments, numEdits, numStates := 0, 0, 0, 0
+	bar := newProgress("Synchronising bugs", len(bugs), verbosity)
+	for _, bug := range bugs {
+		bar.Add(1)
+		issue, ok := state.Bugs[bug.id]
+		if !ok {
+			if verbosity > 1 {
+				fmt.Printf("Posting new bug #%d\n", bug.id)
+			}
+			postBug(bug, owner, repo, credFile, cacheDir, store, state, history)
+			numNew++
+			continue
+		}
+
+		if bug.Hash() != issue.BodyHash {
+			if verbosity > 1 {
+				fmt.Printf("Updating issue #%d (bug #%d)\n", issue.Issue, bug.id)
+			}
+			m := octokit.M{"owner": owner, "repo": repo, "number": issue.Issue}
+			_, result := client.Issues().Update(nil, m, octokit.IssueParams {Title: bug.description, Body: bug.ToString()})
+			if result.HasError() {
+				fmt.Printf("Encountered an error when attempting to update issue #%d\n", issue.Issue)
+				runLog.Error(logContext { bug: bug.id, issue: issue.Issue }, "Unable to update issue: %v", result)
+				log.Fatal(result)
+			}
+			runLog.Info(logContext { bug: bug.id, issue: issue.Issue }, "Updated issue body")
+			issue.BodyHash = bug.Hash()
+			numEdits++
+		}
+
+		// The first comment is the body of the issue.
+		var changed []*Comment
+		for j := 1; j < len(bug.comments); j++ {
+			if posted := issue.FindComment(bug.comments[j].id); posted == nil || posted.Hash != bug.comments[j].Hash() {
+				changed = append(changed, &bug.comments[j])
+			}
+		}
+		publishAttachments(changed, bug.id, cacheDir, store)
+		for _, comment := range changed {
+			posted := issue.FindComment(comment.id)
+			if posted == nil {
+				if verbosity > 1 {
+					fmt.Printf("Posting comment %d on issue #%d (bug #%d)\n", comment.id, issue.Issue, bug.id)
+				}
+				githubComment := postComment(client, owner, repo, bug.id, comment, issue.Issue)
+				state.RecordComment(bug.id, *comment, githubComment.ID)
+				saveState(state)
+				numComments++
+			} else {
+				if verbosity > 1 {
+					fmt.Printf("Updating comment %d on issue #%d (bug #%d)\n", comment.id, issue.Issue, bug.id)
+				}
+				m := octokit.M{"owner": owner, "repo": repo, "id": posted.GithubId}
+				_, result := client.IssueComments().Update(nil, m, octokit.M{"body": comment.ToString()})
+				if result.HasError() {
+					fmt.Printf("Encountered an error when attempting to update comment %d on issue #%d\n", posted.GithubId, issue.Issue)
+					runLog.Error(logContext { bug: bug.id, comment: comment.id, issue: issue.Issue }, "Unable to update comment: %v", result)
+					log.Fatal(result)
+				}
+				runLog.Info(logContext { bug: bug.id, comment: comment.id, issue: issue.Issue }, "Updated comment")
+				state.RecordComment(bug.id, *comment, posted.GithubId)
+				numEdits++
+			}
+		}
+
+		if bug.status != issue.Status {
+			githubIssue := getGithubIssue(client, owner, repo, issue.Issue)
+			if change, changed := reconcileIssue(bug, githubIssue, issue, owner, repo, credFile, policy, true, false); changed {
+				fmt.Printf("#%d (bug #%d, %s): %s -> %s: %s\n", change.Issue, change.LegacyId, change.LegacyStatus, change.From, change.To, change.Action)
+				numStates++
+			}
+		}
+		saveState(state)
+	}
+	state.LastSync = time.Now()
+	saveState(state)
+	bar.Clear()
+	fmt.Printf("Synchronising bugs...Finished! %d new bugs, %d new comments, %d edits, %d state changes.\n", numNew, numComments, numEdits, numStates)
+	runLog.Info(logContext{}, "Synchronised: %d new bugs, %d new comments, %d edits, %d state changes", numNew, numComments, numEdits, numStates)
+}
+
+// Rebuilds the migration state from the issues on GitHub, for repos which were
+// migrated before the state was recorded. Comments are matched to legacy
+// comments in order, for as long as their authors match. Everything which is
+// matched is assumed to be up to date.
+// bugs: The legacy bugs.
+// state: The migration state.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// verbosity: level of output detail.
+func rebuildState(bugs []Bug, state *migrationState, owner, repo, credFile string, verbosity int) {
+	client := newGithubClient(credFile)
+	issues := getGithubIssues(owner, repo, credFile, "all", -1, verbosity)
+	bar := newProgress("Reading migration state from GitHub", len(issues), verbosity)
+	for _, issue := range issues {
+		bar.Add(1)
+		bug, ok := findBugForIssue(bugs, issue)
+		if !ok {
+			continue
+		}
+		if existing, ok := state.Bugs[bug.id]; ok {
+			fmt.Printf("Bug #%d has several issues (#%d and #%d). Run --dedupe first.\n", bug.id, existing.Issue, issue.Number)
+			continue
+		}
+
+		state.RecordIssue(bug, issue.Number, strings.ToLower(issue.State))
+		comments := getIssueComments(client, owner, repo, issue.Number)
+		for j, comment := range comments {
+			if j + 1 >= len(bug.comments) {
+				break
+			}
+			legacy := bug.comments[j + 1]
+			if !strings.HasPrefix(normaliseBody(comment.Body), "Author: " + legacy.author) {
+				break
+			}
+			state.RecordComment(bug.id, legacy, comment.ID)
+		}
+	}
+	bar.Clear()
+	if verbosity > 0 {
+		fmt.Println("Reading migration state from GitHub...Finished!")
+	}
+	saveState(state)
+}
+
+// Saves the migration state, exiting on failure.
+// state: The migration state.
+func saveState(state *migrationState) {
+	if err := state.Save(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncIssues(t *testing.T) {
+	fake := startFakeGithub(t)
+	state := testState(t)
+	bugs := testBugs()
+
+	// The first run posts all of the bugs.
+	syncIssues(bugs, state, "owner", "repo", "", "", nil, conflictPolicyLegacy, historyNone, 0)
+	if fake.NumIssues() != 2 {
+		t.Fatalf("Expected 2 issues, but found %d", fake.NumIssues())
+	}
+
+	// Edit the description and a comment, and add a comment.
+	bugs = testBugs()
+	bugs[0].comments[0].text = "Wheat yields are about a third of what they should be."
+	bugs[0].comments[1].text = "Confirmed in 7.4."
+	bugs[0].comments = append(bugs[0].comments, Comment { id: 13, author: "hol353", date: bugs[0].date.Add(2 * time.Hour), text: "Fixed." })
+	posts, patches := fake.requests["POST"], fake.requests["PATCH"]
+	syncIssues(bugs, state, "owner", "repo", "", "", nil, conflictPolicyLegacy, historyNone, 0)
+
+	if issue := fake.Issue(1); issue.Body != bugs[0].ToString() {
+		t.Errorf("Expected the issue body to be updated, but it's %q", issue.Body)
+	}
+	expected := []string { bugs[0].comments[1].ToString(), bugs[0].comments[2].ToString() }
+	if actual := fake.CommentBodies(1); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected comments %q, but got %q", expected, actual)
+	}
+	// One new comment, and two edits (the issue and comment 12).
+	if fake.requests["POST"] - posts != 1 || fake.requests["PATCH"] - patches != 2 {
+		t.Errorf("Expected 1 POST and 2 PATCHes, but got %d and %d", fake.requests["POST"] - posts, fake.requests["PATCH"] - patches)
+	}
+	saved, err := loadState(state.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := saved.Bugs[1]; record.BodyHash != bugs[0].Hash() || record.FindComment(13) == nil || record.FindComment(12).Hash != bugs[0].comments[1].Hash() {
+		t.Errorf("Unexpected migration state: %+v", record)
+	}
+
+	// Nothing has changed since the last run.
+	posts, patches = fake.requests["POST"], fake.requests["PATCH"]
+	syncIssues(bugs, state, "owner", "repo", "", "", nil, conflictPolicyLegacy, historyNone, 0)
+	if fake.requests["POST"] != posts || fake.requests["PATCH"] != patches {
+		t.Errorf("Expected nothing to change, but got %d POSTs and %d PATCHes", fake.requests["POST"] - posts, fake.requests["PATCH"] - patches)
+	}
+}
+
+func TestRebuildState(t *testing.T) {
+	fake := startFakeGithub(t)
+	state := testState(t)
+	bugs := testBugs()
+
+	// The bugs were migrated before the state was recorded. The comment on
+	// bug 1 was followed by a reply on GitHub.
+	fake.AddIssue(bugs[0].description, bugs[0].ToString(), "open", bugs[0].comments[1].ToString(), "Thanks!")
+	fake.AddIssue(bugs[1].description, bugs[1].ToString(), "closed")
+
+	syncIssues(bugs, state, "owner", "repo", "", "", nil, conflictPolicyLegacy, historyNone, 0)
+	if fake.requests["POST"] != 0 || fake.requests["PATCH"] != 0 {
+		t.Errorf("Expected nothing to be posted, but got %d POSTs and %d PATCHes", fake.requests["POST"], fake.requests["PATCH"])
+	}
+
+	saved, err := loadState(state.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Bugs) != 2 || saved.Bugs[1].Issue != 1 || saved.Bugs[2].Issue != 2 || saved.Bugs[2].IssueState != "closed" {
+		t.Fatalf("Unexpected migration state: %+v", saved.Bugs)
+	}
+	// The reply isn't a legacy comment.
+	if comments := saved.Bugs[1].Comments; len(comments) != 1 || comments[0].Id != 12 || comments[0].GithubId != 1 {
+		t.Errorf("Unexpected comment state: %+v", comments)
+	}
+}
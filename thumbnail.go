@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Creates a JPEG thumbnail of an image, no larger than maxSize pixels in
+// either dimension. The thumbnail is written next to the original image.
+// Returns the path of the thumbnail, or an empty string if the image is
+// already small enough not to need one.
+// localFile: Path to the image.
+// maxSize: Maximum width/height of the thumbnail in pixels.
+func createThumbnail(localFile string, maxSize int) (string, error) {
+	in, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	
+	src, _, err := image.Decode(in)
+	if err != nil {
+		return "", err
+	}
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return "", nil
+	}
+	
+	// Scale the longest side down to maxSize, preserving the aspect ratio.
+	thumbWidth, thumbHeight := maxSize, height * maxSize / width
+	if height > width {
+		thumbWidth, thumbHeight = width * maxSize / height, maxSize
+	}
+	if thumbWidth < 1 {
+		thumbWidth = 1
+	}
+	if thumbHeight < 1 {
+		thumbHeight = 1
+	}
+	
+	// Each pixel in the thumbnail is the average of the block of pixels in the
+	// original image which it covers. JPEG has no transparency, so transparent
+	// pixels are drawn onto a white background.
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0 := bounds.Min.Y + y * height / thumbHeight
+		y1 := bounds.Min.Y + maxInt((y + 1) * height / thumbHeight, y * height / thumbHeight + 1)
+		for x := 0; x < thumbWidth; x++ {
+			x0 := bounds.Min.X + x * width / thumbWidth
+			x1 := bounds.Min.X + maxInt((x + 1) * width / thumbWidth, x * width / thumbWidth + 1)
+			var r, g, b, a, n uint64
+			// Colours returned by At() are alpha-premultiplied.
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r + uint64(pr), g + uint64(pg), b + uint64(pb), a + uint64(pa), n + 1
+				}
+			}
+			background := 0xffff - a / n
+			i := thumb.PixOffset(x, y)
+			thumb.Pix[i] = uint8((r / n + background) >> 8)
+			thumb.Pix[i + 1] = uint8((g / n + background) >> 8)
+			thumb.Pix[i + 2] = uint8((b / n + background) >> 8)
+			thumb.Pix[i + 3] = 0xff
+		}
+	}
+	
+	thumbFile := filepath.Join(filepath.Dir(localFile), "thumb_" + strings.TrimSuffix(filepath.Base(localFile), filepath.Ext(localFile)) + ".jpg")
+	out, err := os.Create(thumbFile)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if err = jpeg.Encode(out, thumb, &jpeg.Options { Quality: 85 }); err != nil {
+		return "", err
+	}
+	return thumbFile, out.Close()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/octokit/go-octokit/octokit"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A difference between a legacy bug and its GitHub issue.
+type discrepancy struct {
+	LegacyId	int64	`json:"legacyId,omitempty"`
+	Issue		int		`json:"issue,omitempty"`
+	// One of: missing-issue, duplicate-issue, orphan-issue, issue-body,
+	// comment-count, comment-body, state, attachment.
+	Kind		string	`json:"kind"`
+	Detail		string	`json:"detail"`
+}
+
+// Maximum number of characters of a comment body included in a report.
+const maxExcerptLength = 200
+
+// Compares the legacy bugs to the GitHub issues they were migrated to.
+// Checks that each bug has exactly one issue, that each issue has the same
+// comments as its bug, that their open/closed states match and (optionally)
+// that all attachment links resolve.
+// bugs: The legacy bugs.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// credFile: path to a file on disk containing a github personal access token.
+// complete: True if bugs contains every legacy bug, so that any other issue which claims to be a legacy bug is reported.
+// checkAttachments: If true, check that every attachment link resolves.
+// verbosity: level of output detail.
+func verifyMigration(bugs []Bug, owner, repo, credFile string, complete, checkAttachments bool, verbosity int) (report []discrepancy) {
+	client := newGithubClient(credFile)
+	issues := getGithubIssues(owner, repo, credFile, "all", -1, verbosity)
+
+	// Match issues to legacy bugs.
+	issuesByBug := make(map[int64][]octokit.Issue)
+	for _, issue := range issues {
+		legacyId := int64(getLegacyId(issue))
+		if legacyId < 0 {
+			bug, ok := findBugByTitle(bugs, issue.Title)
+			if !ok {
+				continue
+			}
+			legacyId = bug.id
+		}
+		issuesByBug[legacyId] = append(issuesByBug[legacyId], issue)
+	}
+
+	known := make(map[int64]bool)
+	bar := newProgress("Verifying issues", len(bugs), verbosity)
+	for _, bug := range bugs {
+		bar.Add(1)
+		known[bug.id] = true
+		matches := issuesByBug[bug.id]
+		if len(matches) == 0 {
+			report = append(report, discrepancy { LegacyId: bug.id, Kind: "missing-issue", Detail: "No issue found for legacy bug" })
+			continue
+		}
+		if len(matches) > 1 {
+			numbers := make([]string, len(matches))
+			for j, issue := range matches {
+				numbers[j] = fmt.Sprintf("#%d", issue.Number)
+			}
+			report = append(report, discrepancy { LegacyId: bug.id, Kind: "duplicate-issue", Detail: "Legacy bug has several issues: " + strings.Join(numbers, ", ") })
+			continue
+		}
+		report = append(report, verifyIssue(client, owner, repo, bug, matches[0], checkAttachments)...)
+	}
+	bar.Clear()
+	if verbosity > 0 {
+		fmt.Println("Verifying issues...Finished!")
+	}
+
+	if complete {
+		for legacyId, matches := range issuesByBug {
+			if !known[legacyId] {
+				for _, issue := range matches {
+					report = append(report, discrepancy { LegacyId: legacyId, Issue: issue.Number, Kind: "orphan-issue", Detail: "Issue refers to a legacy bug which doesn't exist" })
+				}
+			}
+		}
+	}
+	return
+}
+
+// Compares a legacy bug to its GitHub issue.
+// client: GitHub API client.
+// owner: Owner of the repo.
+// repo: Name of the repo.
+// bug: The legacy bug.
+// issue: The issue to which the bug was migrated.
+// checkAttachments: If true, check that every attachment link resolves.
+func verifyIssue(client *octokit.Client, owner, repo string, bug Bug, issue octokit.Issue, checkAttachments bool) (report []discrepancy) {
+	add := func(kind, detail string) {
+		report = append(report, discrepancy { LegacyId: bug.id, Issue: issue.Number, Kind: kind, Detail: detail })
+	}
+
+	if bug.IsClosed() != (strings.ToLower(issue.State) == "closed") {
+		add("state", fmt.Sprintf("Legacy status is %s but issue is %s", bug.status, issue.State))
+	}
+	if !sameBody(normaliseBody(bug.ToString()), normaliseBody(issue.Body)) {
+		add("issue-body", fmt.Sprintf("Issue body differs. Expected \"%s\" but found \"%s\"", excerpt(bug.ToString()), excerpt(issue.Body)))
+	}
+
+	// The first legacy comment is the description of the bug, which is
+	// posted as the body of the issue rather than as a comment.
+	var expected []Comment
+	if len(bug.comments) > 1 {
+		expected = bug.comments[1:]
+	}
+	var actual []octokit.IssueComment
+	for _, comment := range getIssueComments(client, owner, repo, issue.Number) {
+		// Timeline and relationship comments don't correspond to legacy comments.
+		if !strings.HasPrefix(comment.Body, historyHeader) && !strings.HasPrefix(comment.Body, relationsHeader) && !strings.HasPrefix(comment.Body, subscribersHeader) {
+			actual = append(actual, comment)
+		}
+	}
+	if len(expected) != len(actual) {
+		add("comment-count", fmt.Sprintf("Legacy bug has %d comments but issue has %d", len(expected), len(actual)))
+	}
+
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		if len(expected[i].attachments) == 0 {
+			if !sameBody(normaliseBody(expected[i].ToString()), normaliseBody(actual[i].Body)) {
+				add("comment-body", fmt.Sprintf("Comment %d (legacy comment %d) differs. Expected \"%s\" but found \"%s\"", i + 1, expected[i].id, excerpt(expected[i].ToString()), excerpt(actual[i].Body)))
+			}
+			continue
+		}
+
+		// Attachment links are rewritten when the files are uploaded, so just
+		// check that each attachment is present.
+		for _, attachment := range expected[i].attachments {
+			if !strings.Contains(actual[i].Body, escapeMarkdown(attachment.name)) {
+				add("comment-body", fmt.Sprintf("Comment %d (legacy comment %d) is missing attachment %s", i + 1, expected[i].id, attachment.name))
+			}
+		}
+		if checkAttachments {
+			for _, link := range getLinks(actual[i].Body) {
+				if err := checkUrl(link); err != nil {
+					add("attachment", fmt.Sprintf("Comment %d (legacy comment %d): %v", i + 1, expected[i].id, err))
+				}
+			}
+		}
+	}
+	return
+}
+
+// Normalises a comment body for comparison. Tabs are ignored because they
+// were stripped from some issues after they were posted.
+// body: The comment body.
+func normaliseBody(body string) string {
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	body = strings.Replace(body, "\t", "", -1)
+	return strings.TrimSpace(body)
+}
+
+// Layouts in which the Date line of a comment has been written. Older
+// migrations printed the time.Time with %v.
+var commentDateLayouts = []string { "2006-01-02 15:04 -07:00", "2006-01-02", "2006-01-02 15:04:05 -0700 MST" }
+
+// Checks whether two issue or comment bodies are the same. The Date lines in
+// their headers are compared by value, as older migrations rendered dates in
+// a different format.
+// expected: The body the issue or comment should have.
+// actual: The body of the issue or comment on GitHub.
+func sameBody(expected, actual string) bool {
+	expectedLines := strings.Split(expected, "\n")
+	actualLines := strings.Split(actual, "\n")
+	if len(expectedLines) != len(actualLines) {
+		return false
+	}
+	// The header comes before the text, so its Date line is the first one.
+	headerDate := -1
+	for i, line := range expectedLines {
+		if strings.HasPrefix(line, "Date: ") {
+			headerDate = i
+			break
+		}
+	}
+	for i := range expectedLines {
+		isHeaderDate := i == headerDate && strings.HasPrefix(actualLines[i], "Date: ")
+		if expectedLines[i] != actualLines[i] && !(isHeaderDate && sameDate(expectedLines[i][6:], actualLines[i][6:])) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks whether two dates from comment headers are the same. Older
+// migrations interpreted the bug tracker's times as UTC, so the times are
+// compared as they'd appear on the bug tracker, ignoring their UTC offsets.
+// If either has no time, only the days are compared.
+// a: The first date.
+// b: The second date.
+func sameDate(a, b string) bool {
+	parse := func(text string) (time.Time, bool) {
+		for _, layout := range commentDateLayouts {
+			if date, err := time.Parse(layout, text); err == nil {
+				return date, true
+			}
+		}
+		return time.Time{}, false
+	}
+	dateA, ok := parse(a)
+	if !ok {
+		return false
+	}
+	dateB, ok := parse(b)
+	if !ok {
+		return false
+	}
+	layout := "2006-01-02 15:04"
+	if !strings.Contains(a, ":") || !strings.Contains(b, ":") {
+		layout = "2006-01-02"
+	}
+	return dateA.Format(layout) == dateB.Format(layout)
+}
+
+// Shortens text for inclusion in a report.
+// text: The text.
+func excerpt(text string) string {
+	if len(text) > maxExcerptLength {
+		return text[:maxExcerptLength] + "..."
+	}
+	return text
+}
+
+// Gets the destinations of all Markdown links and images in some text.
+// text: Markdown text.
+func getLinks(text string) (links []string) {
+	re := regexp.MustCompile(`\]\((https?://[^)\s]+)\)`)
+	for _, match := range re.FindAllStringSubmatch(text, -1) {
+		links = append(links, match[1])
+	}
+	return
+}
+
+// Checks that a URL resolves to a file.
+// url: The URL.
+func checkUrl(url string) error {
+	response, err := http.Head(url)
+	if err == nil && response.StatusCode == http.StatusMethodNotAllowed {
+		// Not all servers support HEAD requests.
+		response.Body.Close()
+		response, err = http.Get(url)
+	}
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return nil
+}
+
+// Writes a verification report to a file, as JSON.
+// file: Path of the report.
+// report: The discrepancies.
+func writeVerifyReport(file string, report []discrepancy) error {
+	if report == nil {
+		report = []discrepancy{}
+	}
+	data, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSameBody(t *testing.T) {
+	expected := "Author: drew\nDate: 2012-03-15 14:50 +10:00\n\nDate: tomorrow"
+	tests := []struct {
+		actual	string
+		same	bool
+	}{
+		{ expected, true },
+		// Written by an older migration, which interpreted times as UTC.
+		{ "Author: drew\nDate: 2012-03-15 14:50:00 +0000 UTC\n\nDate: tomorrow", true },
+		{ "Author: drew\nDate: 2012-03-15 14:51:00 +0000 UTC\n\nDate: tomorrow", false },
+		{ "Author: drew\nDate: 2012-03-16 14:50 +10:00\n\nDate: tomorrow", false },
+		// Only the header's Date line is compared by value.
+		{ "Author: drew\nDate: 2012-03-15 14:50 +10:00\n\nDate: today", false },
+		{ "Author: drew\nDate: 2012-03-15 14:50 +10:00\n\nDate: tomorrow\nmore", false },
+		{ "Author: bob\nDate: 2012-03-15 14:50 +10:00\n\nDate: tomorrow", false },
+	}
+	for _, test := range tests {
+		if same := sameBody(expected, test.actual); same != test.same {
+			t.Errorf("Expected sameBody(%q) to be %v", test.actual, test.same)
+		}
+	}
+
+	// Comments with only a date on the bug tracker.
+	if !sameBody("Author: drew\nDate: 2012-03-15\n\nHi", "Author: drew\nDate: 2012-03-15 00:00:00 +0000 UTC\n\nHi") {
+		t.Error("Expected a date without a time to match the same day")
+	}
+}
+
+func TestVerifyMigration(t *testing.T) {
+	fake := startFakeGithub(t)
+	bugs := testBugs()
+	// Issue #1 was migrated by an older version, which wrote dates as UTC.
+	old := strings.Replace(bugs[0].ToString(), "Date: 2012-03-14 09:05 +00:00", "Date: 2012-03-14 09:05:00 +0000 UTC", 1)
+	if old == bugs[0].ToString() {
+		t.Fatalf("Expected the issue body to have a date, but got %q", old)
+	}
+	fake.AddIssue(bugs[0].description, old, "open", bugs[0].comments[1].ToString())
+	if report := verifyMigration(bugs[:1], "owner", "repo", "", true, false, 0); len(report) != 0 {
+		t.Errorf("Expected no discrepancies, but got %+v", report)
+	}
+
+	// Issue #2 has been edited by hand, and reopened.
+	edited := strings.Replace(bugs[1].ToString(), "APSIM crashes.", "APSIM crashes sometimes.", 1)
+	fake.AddIssue(bugs[1].description, edited, "open")
+	// Issue #3 claims to be a legacy bug which doesn't exist.
+	fake.AddIssue("Orphan", "Legacy Bug ID: 99", "open")
+	kinds := make(map[string]int)
+	for _, entry := range verifyMigration(bugs, "owner", "repo", "", true, false, 0) {
+		kinds[entry.Kind] = entry.Issue
+	}
+	expected := map[string]int { "issue-body": 2, "state": 2, "orphan-issue": 3 }
+	if len(kinds) != len(expected) {
+		t.Errorf("Expected discrepancies %v, but got %v", expected, kinds)
+	}
+	for kind, issue := range expected {
+		if kinds[kind] != issue {
+			t.Errorf("Expected a %s discrepancy for issue #%d, but got %v", kind, issue, kinds)
+		}
+	}
+}